@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/filters"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// Command is a kodama subcommand
+type Command struct {
+	Usage string
+	Doc   string
+	Run   func(args []string) error
+}
+
+// available subcommands, by name
+var commands = map[string]*Command{
+	"filters": {"filters [name...]", "lists available filters and their parameters", FiltersCommand},
+	"exif":    {"exif [-json] [-tags name,...] file.cr2...", "prints the tags of CR2 files, grouped by IFD", ExifCommand},
+	"extract": {"extract [-image preview|thumbnail|rgb|raw] [-o dir] file.cr2...", "extracts an image embedded in CR2 files", ExtractCommand},
+}
+
+// FiltersCommand prints the usage of filters, all of them if none is given
+func FiltersCommand(args []string) error {
+	fs := flag.NewFlagSet("filters", flag.ExitOnError)
+	fs.Parse(args)
+
+	schemas := filters.Schemas()
+	if fs.NArg() > 0 {
+		schemas = nil
+		for _, name := range fs.Args() {
+			schema := filters.Lookup(name)
+			if schema == nil {
+				return errors.New(fmt.Sprintf("unknown filter: %s", name))
+			}
+			schemas = append(schemas, schema)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, schema := range schemas {
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "%s\n", schema.Usage())
+		fmt.Fprintf(w, "    %s\n", schema.Doc)
+		for _, p := range schema.Params {
+			constraint := ""
+			if p.Range != nil {
+				constraint = p.Range.String()
+			}
+			if len(p.Choices) > 0 {
+				constraint = strings.Join(p.Choices, "|")
+			}
+			doc := p.Doc
+			if p.Default != "" {
+				doc = fmt.Sprintf("%s (default: %s)", doc, p.Default)
+			}
+			fmt.Fprintf(w, "    %s\t%s\t%s\t%s\n", p.Name, p.KindName(), constraint, doc)
+		}
+	}
+	return w.Flush()
+}
+
+// extractImage returns an embedded image of a CR2 file as a JPEG, JPEG
+// images are copied without re-encoding
+func extractImage(p string, which int) ([]byte, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := cr2.Open(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if which == cr2.IMAGE_PREVIEW || which == cr2.IMAGE_THUMBNAIL {
+		return f.ExtractJPEG(which)
+	}
+	img, err := f.Embedded(which)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, nil)
+	return buf.Bytes(), err
+}
+
+// ExtractCommand writes an embedded image of each CR2 file as a JPEG
+// named after the file
+func ExtractCommand(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	name := fs.String("image", "preview", "embedded image: "+strings.Join(cr2.EmbeddedImages, "|"))
+	dir := fs.String("o", ".", "output directory")
+	fs.Parse(args)
+
+	which := -1
+	for i, n := range cr2.EmbeddedImages {
+		if n == *name {
+			which = i
+		}
+	}
+	if which < 0 {
+		return errors.New(fmt.Sprintf("unknown embedded image: %s", *name))
+	}
+
+	for _, p := range fs.Args() {
+		data, err := extractImage(p, which)
+		if err != nil {
+			return errors.New(fmt.Sprintf("can't extract %s image of %s: %s", *name, p, err.Error()))
+		}
+		base := strings.TrimSuffix(filepath.Base(p), filepath.Ext(p))
+		out := filepath.Join(*dir, fmt.Sprintf("%s-%s.jpg", base, *name))
+		err = ioutil.WriteFile(out, data, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s -> %s\n", p, out)
+	}
+	return nil
+}
+
+// exifDirectories returns the IFDs of a CR2 file, only with the given tags
+// if any
+func exifDirectories(p string, names map[string]bool) ([]*cr2.Directory, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := cr2.Open(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	res := []*cr2.Directory{}
+	for _, dir := range f.Metadata().Directories {
+		if dir.Err != nil {
+			fmt.Fprintf(os.Stderr, "warning: can't read %s of %s: %s\n", dir.Name, p, dir.Err.Error())
+			continue
+		}
+		kept := &cr2.Directory{Name: dir.Name, Tags: make(map[string]string)}
+		for _, name := range dir.Names {
+			if len(names) == 0 || names[name] {
+				kept.Tags[name] = dir.Tags[name]
+				kept.Names = append(kept.Names, name)
+			}
+		}
+		if len(kept.Names) > 0 {
+			res = append(res, kept)
+		}
+	}
+	return res, nil
+}
+
+// ExifCommand prints the tags of each file as a table, or as JSON objects
+// mapping IFD names to their tags
+func ExifCommand(args []string) error {
+	fs := flag.NewFlagSet("exif", flag.ExitOnError)
+	as_json := fs.Bool("json", false, "print JSON instead of a table")
+	tags := fs.String("tags", "", "comma separated names of the tags to print, all if empty")
+	fs.Parse(args)
+
+	names := make(map[string]bool)
+	for _, name := range strings.Split(*tags, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+
+	output := make(map[string]map[string]map[string]string)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, p := range fs.Args() {
+		dirs, err := exifDirectories(p, names)
+		if err != nil {
+			return errors.New(fmt.Sprintf("can't read tags of %s: %s", p, err.Error()))
+		}
+		if *as_json {
+			output[p] = make(map[string]map[string]string)
+			for _, dir := range dirs {
+				output[p][dir.Name] = dir.Tags
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "%s\n", p)
+		for _, dir := range dirs {
+			fmt.Fprintf(w, "  %s\n", dir.Name)
+			for _, name := range dir.Names {
+				fmt.Fprintf(w, "    %s\t%s\n", name, dir.Tags[name])
+			}
+		}
+	}
+
+	if *as_json {
+		data, err := json.MarshalIndent(output, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+		return nil
+	}
+	return w.Flush()
+}
@@ -0,0 +1,191 @@
+package cr2
+
+import (
+	"math"
+)
+
+// AHD works on tiles to bound its memory usage, each tile is processed
+// with a margin of samples shared with its neighbours.
+const (
+	ahdTile   = 128
+	ahdMargin = 4
+)
+
+// demosaicAHD interpolates missing colors in the direction (horizontal
+// or vertical) giving the most homogeneous result in CIELab, and returns
+// interleaved RGB values
+func demosaicAHD(c *cfa) []float32 {
+	res := make([]float32, c.Width*c.Height*3)
+	for y := 0; y < c.Height; y += ahdTile {
+		for x := 0; x < c.Width; x += ahdTile {
+			x_end := x + ahdTile
+			if x_end > c.Width {
+				x_end = c.Width
+			}
+			y_end := y + ahdTile
+			if y_end > c.Height {
+				y_end = c.Height
+			}
+			ahdTileProcess(c, res, x, y, x_end, y_end)
+		}
+	}
+	return res
+}
+
+// ahdTileProcess demosaics the samples of [x0, x1) * [y0, y1)
+func ahdTileProcess(c *cfa, res []float32, x0, y0, x1, y1 int) {
+	// origin and dimensions of the tile, margins included
+	ox := x0 - ahdMargin
+	oy := y0 - ahdMargin
+	tw := x1 - x0 + 2*ahdMargin
+	th := y1 - y0 + 2*ahdMargin
+	n := tw * th
+
+	var green [2][]float32
+	var rgb [2][]float32
+	var lab [2][]float32
+	var homo [2][]uint8
+	for d := 0; d < 2; d++ {
+		green[d] = make([]float32, n)
+		rgb[d] = make([]float32, n*3)
+		lab[d] = make([]float32, n*3)
+		homo[d] = make([]uint8, n)
+	}
+
+	// green, interpolated horizontally (d = 0) and vertically (d = 1)
+	for ry := 0; ry < th; ry++ {
+		for rx := 0; rx < tw; rx++ {
+			x, y := ox+rx, oy+ry
+			p := ry*tw + rx
+			v := c.at(x, y)
+			if c.color(x, y) == 1 {
+				green[0][p] = v
+				green[1][p] = v
+				continue
+			}
+			green[0][p] = interpolateGreen(v, c.at(x-1, y), c.at(x+1, y), c.at(x-2, y), c.at(x+2, y))
+			green[1][p] = interpolateGreen(v, c.at(x, y-1), c.at(x, y+1), c.at(x, y-2), c.at(x, y+2))
+		}
+	}
+
+	// red and blue from color differences, then CIELab
+	for d := 0; d < 2; d++ {
+		g := green[d]
+		for ry := 1; ry < th-1; ry++ {
+			for rx := 1; rx < tw-1; rx++ {
+				x, y := ox+rx, oy+ry
+				p := ry*tw + rx
+				out := rgb[d][p*3 : p*3+3]
+				col := c.color(x, y)
+				out[1] = g[p]
+				if col == 1 {
+					out[c.color(x+1, y)] = g[p] + (c.at(x-1, y)-g[p-1]+c.at(x+1, y)-g[p+1])/2
+					out[c.color(x, y+1)] = g[p] + (c.at(x, y-1)-g[p-tw]+c.at(x, y+1)-g[p+tw])/2
+				} else {
+					out[col] = c.at(x, y)
+					out[2-col] = g[p] + (c.at(x-1, y-1)-g[p-tw-1]+
+						c.at(x+1, y-1)-g[p-tw+1]+
+						c.at(x-1, y+1)-g[p+tw-1]+
+						c.at(x+1, y+1)-g[p+tw+1])/4
+				}
+				toLab(out, lab[d][p*3:p*3+3])
+			}
+		}
+	}
+
+	// homogeneity: number of neighbours close to each sample in CIELab
+	offsets := [4]int{-1, 1, -tw, tw}
+	for ry := 2; ry < th-2; ry++ {
+		for rx := 2; rx < tw-2; rx++ {
+			p := ry*tw + rx
+			var ldiff, abdiff [2][4]float32
+			for d := 0; d < 2; d++ {
+				l := lab[d]
+				for k, off := range offsets {
+					q := p + off
+					ldiff[d][k] = float32(math.Abs(float64(l[p*3] - l[q*3])))
+					da := l[p*3+1] - l[q*3+1]
+					db := l[p*3+2] - l[q*3+2]
+					abdiff[d][k] = da*da + db*db
+				}
+			}
+			leps := min32(max32(ldiff[0][0], ldiff[0][1]), max32(ldiff[1][2], ldiff[1][3]))
+			abeps := min32(max32(abdiff[0][0], abdiff[0][1]), max32(abdiff[1][2], abdiff[1][3]))
+			for d := 0; d < 2; d++ {
+				for k := 0; k < 4; k++ {
+					if ldiff[d][k] <= leps && abdiff[d][k] <= abeps {
+						homo[d][p]++
+					}
+				}
+			}
+		}
+	}
+
+	// pick the most homogeneous direction around each sample
+	for ry := ahdMargin; ry < th-ahdMargin; ry++ {
+		for rx := ahdMargin; rx < tw-ahdMargin; rx++ {
+			p := ry*tw + rx
+			var hm [2]int
+			for d := 0; d < 2; d++ {
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						hm[d] += int(homo[d][p+dy*tw+dx])
+					}
+				}
+			}
+			out := res[((oy+ry)*c.Width+ox+rx)*3:]
+			for i := 0; i < 3; i++ {
+				switch {
+				case hm[0] > hm[1]:
+					out[i] = rgb[0][p*3+i]
+				case hm[0] < hm[1]:
+					out[i] = rgb[1][p*3+i]
+				default:
+					out[i] = (rgb[0][p*3+i] + rgb[1][p*3+i]) / 2
+				}
+			}
+		}
+	}
+}
+
+// interpolateGreen estimates green at a red or blue sample v, from its
+// green neighbours a and b and the same color samples aa and bb beyond
+func interpolateGreen(v, a, b, aa, bb float32) float32 {
+	g := (a+b)/2 + (2*v-aa-bb)/4
+	return min32(max32(g, min32(a, b)), max32(a, b))
+}
+
+// toLab converts a linear RGB color to CIELab (D65)
+func toLab(rgb []float32, lab []float32) {
+	var xyz [3]float64
+	white := [3]float64{0.950456, 1, 1.088754}
+	for i := 0; i < 3; i++ {
+		v := xyzRGB[i*3]*float64(rgb[0]) + xyzRGB[i*3+1]*float64(rgb[1]) + xyzRGB[i*3+2]*float64(rgb[2])
+		v /= white[i]
+		if v > 0.008856 {
+			v = math.Cbrt(v)
+		} else {
+			v = 7.787*v + 16.0/116
+		}
+		xyz[i] = v
+	}
+	lab[0] = float32(116*xyz[1] - 16)
+	lab[1] = float32(500 * (xyz[0] - xyz[1]))
+	lab[2] = float32(200 * (xyz[1] - xyz[2]))
+}
+
+// min32 returns the smallest of two floats
+func min32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// max32 returns the greatest of two floats
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
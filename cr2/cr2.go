@@ -9,15 +9,14 @@ package cr2
 
 import (
 	"bytes"
-	"encoding/binary"
-	"errors"
 	"image"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"fmt"
-	"bufio"
-	"image/jpeg"
 	"strconv"
+	"github.com/aimxhaisse/kodama/ljpeg"
+	"github.com/aimxhaisse/kodama/tiff"
 )
 
 // Header of a little endian cr2 file:
@@ -25,292 +24,410 @@ import (
 // 49 49 2a 00 10 00 00 00 43 52 02 00
 const cr2Header = "\x49\x49\x2a\x00????\x43\x52\x02\x00"
 
+// A FormatError reports that the input is not a valid CR2 image
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "cr2: invalid format: " + string(e)
+}
+
+// An UnsupportedError reports that the input uses a valid but unimplemented feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "cr2: unsupported feature: " + string(e)
+}
+
 // decoder is the internal representation of a cr2 file
 type decoder struct {
-	buf *bytes.Reader      // entire cr2 file in memory
+	r io.ReaderAt           // cr2 file, only read where needed
+	tiff *tiff.Reader      // IFD walker
 	Tags map[string]string // tiff tags (last image overwrites previous values)
+	Ifds []*ifd            // IFDs of the four images
+	SubIfds []*ifd         // IFDs referenced by tags (Exif, GPS, MakerNote)
+	visited map[uint32]bool // offsets of the scanned IFDs, to detect loops
 }
 
-// scanHeader scans the tiff header
-func (d decoder) scanHeader() error {
-	head := make([]byte, 4)
-	n, err := d.buf.Read(head)
-	if err != nil {
-		return nil
-	}
-	if n != 4 || string(head) != "\x49\x49\x2a\x00" {
-		return errors.New("cr2: not a cr2 file")
-	}
-	return nil
+// ifd contains the tiff tags of an image file directory
+type ifd struct {
+	Name    string
+	Entries map[uint16]tiff.Tag // raw tags, by id
+	Tags    map[string]string   // prettified tags, by name
+	Names   []string            // names of the prettified tags, in file order
+	Err     error               // why the IFD can't be read, its tags being then missing
 }
 
-// tiffTag represents a tiff tag
-type tiffTag struct {
-	Id    uint16
-	Kind  uint16
-	Nb    uint32
-	Value uint32
+// newIfd returns an empty IFD
+func newIfd(name string) *ifd {
+	return &ifd{name, make(map[uint16]tiff.Tag), make(map[string]string), nil, nil}
 }
 
-// available kinds for a tiffTag
-const (
-	KIND_UNKNOWN = iota
-	KIND_UCHAR
-	KIND_STRING
-	KIND_USHORT
-	KIND_ULONG
-	KIND_URATIO
-	KIND_CHAR
-	KIND_BYTES
-	KIND_SHORT
-	KIND_LONG
-	KIND_RATIO
-	KIND_FLOAT32
-	KIND_FLOAT64
-)
+// newDecoder reads a whole cr2 file in memory and scans all its tags
+func newDecoder(r io.Reader) (*decoder, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return newDecoderAt(bytes.NewReader(buf), int64(len(buf)))
+}
 
-// known tiff tags names
-type TagNames map[uint16]string
-
-var tag_names = TagNames{
-	0x0100: "ImageWidth",
-	0x0101: "ImageHeight",
-	0x0102: "BitsPerSample",
-	0x0103: "Compression",
-	0x0106: "PhotometricInterpretation",
-	0x010F: "Maker",
-	0x0110: "Model",
-	0x0111: "StripOffset",
-	0x0112: "Orientation",
-	0x0115: "SamplesPerPixel",
-	0x0116: "RowsPerStrip",
-	0x0117: "StripByteCounts",
-	0x011A: "XResolution",
-	0x011B: "YResolution",
-	0x011C: "PlanarConfiguration",
-	0x0128: "ResolutionUnit",
-	0x0132: "DateTime",
-	0x013B: "Artist",
-	0x0201: "JPEGInterchangeFormat",
-	0x0202: "JPEGInterchangeFormatLength",
-	0x02BC: "XMP",
-	0x8298: "Copyright",
-	0x8769: "Exif",
-	0x8825: "GPSData",
-	0x829A: "ExposureTime",
-	0x8822: "ExposureProgram",
-	0x8827: "ISOSpeedRatings",
-	0x8830: "SensitivityType",
-	0x8832: "RecommendedExposureIndex",
-	0x9000: "ExifVersion",
-	0x9003: "DateTimeOriginal",
-	0x9004: "CreateDate",
-	0x9101: "ComponentsConfiguration",
-	0x9102: "CompressedBitsPerPixel",
-	0x9201: "ShutterSpeedValue",
-	0x9202: "ApertureValue",
-	0x9204: "ExposureCompensation",
-	0x9207: "MeteringMode",
-	0x9209: "Flash",
-	0x920A: "FocalLength",
-	0x927C: "MakerNoteCanon",
-	0x9286: "UserComment",
-	0x9290: "SubSecTime",
-	0x9291: "SubSecTimeOriginal",
-	0x9292: "SubSecTimeDigitized",
-	0xA000: "FlashpixVersion",
-	0xA001: "ColorSpace",
-	0xA002: "ExifImageWidth",
-	0xA003: "ExifImageHeight",
-	0xA005: "InteropOffset",
-	0xA20E: "FocalPlaneXResolution",
-	0xA20F: "FocalPlaneYResolution",
-	0xA210: "FocalPlaneResolutionUnit",
-	0xA401: "CustomRendered",
-	0xA402: "ExposureMode",
-	0xA403: "WhiteBalance",
-	0xA406: "SceneCaptureType",
-	0xA430: "OwnerName",
-	0xA431: "SerialNumber",
-	0xA432: "LensInfo",
-	0xA434: "LensModel",
-	0xA435: "LensSerialNumber",
-	0xC640: "CR2Slices",
+// newDecoderAt scans all the tags of a cr2 file of size bytes
+func newDecoderAt(r io.ReaderAt, size int64) (*decoder, error) {
+	d := &decoder{
+		r:       r,
+		Tags:    make(map[string]string),
+		visited: make(map[uint32]bool),
+	}
+	err := d.scanHeader(size)
+	if err != nil {
+		return nil, err
+	}
+	err = d.scanMetaData()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
-// String dumps the attributes of a tiffTag
-func (t tiffTag) String() string {
-	return fmt.Sprintf("id=0x%04x, kind=0x%04x, nb=0x%08x", t.Id, t.Kind, t.Nb)
+// scanHeader scans the tiff header, followed by the CR2 magic
+func (d *decoder) scanHeader(size int64) error {
+	t, err := tiff.NewReader(d.r, size)
+	if err != nil {
+		return FormatError("not a cr2 file")
+	}
+	magic := make([]byte, 2)
+	_, err = d.r.ReadAt(magic, 8)
+	if err != nil || string(magic) != "CR" {
+		return FormatError("not a cr2 file")
+	}
+	d.tiff = t
+	return nil
 }
 
-// prettify returns a key and a value representing the tag
-func (t tiffTag) prettify(r *bytes.Reader) (k string, v string, err error) {
-	k, ok := tag_names[t.Id]
-	if !ok {
-		k = fmt.Sprintf("UnknownTag(0x%04X)", t.Id)
+// ushorts returns the values of a tiff tag of unsigned shorts
+func (d *decoder) ushorts(t tiff.Tag) ([]uint16, error) {
+	if t.Kind != tiff.KIND_USHORT {
+		return nil, FormatError(fmt.Sprintf("tag 0x%04x is not made of unsigned shorts", t.Id))
+	}
+	values, err := d.tiff.Uints(t)
+	if err != nil {
+		return nil, err
 	}
+	res := make([]uint16, len(values))
+	for i, v := range values {
+		res[i] = uint16(v)
+	}
+	return res, nil
+}
 
-	// backup current offset before reading in buffer
-	back, err := r.Seek(0, 1)
+// scanImageFileDirectory scans all tiff tags of the IFD at offset, and
+// recursively the EXIF, GPS and maker note sub-directories; sub-directories
+// that can't be read are kept empty, with their error
+func (d *decoder) scanImageFileDirectory(name string, offset uint32, names tiff.TagNames) (*ifd, uint32, error) {
+	if d.visited[offset] {
+		return nil, 0, FormatError(fmt.Sprintf("loop of IFDs at 0x%08x", offset))
+	}
+	d.visited[offset] = true
+	t, err := d.tiff.ReadIFD(offset)
 	if err != nil {
-		return k, v, err
+		return nil, 0, err
 	}
+	dir := newIfd(name)
+	for _, id := range t.Ids {
+		tag := t.Entries[id]
+		k := names.Name(id)
+		dir.Entries[id] = tag
+		v, err := d.tiff.Format(tag)
+		if err == nil {
+			d.Tags[k] = v
+			dir.Tags[k] = v
+			dir.Names = append(dir.Names, k)
+		}
 
-	// ensure offset is restored
-	defer func (back int64, r *bytes.Reader) {
-		r.Seek(back, 0)
-	}(back, r)
+		sub_name, sub_names := "", tiff.Names
+		switch {
+		case k == "Exif":
+			sub_name = "Exif"
+		case k == "GPSData":
+			sub_name, sub_names = "GPS", gps_names
+		case name == "Exif" && k == "MakerNoteCanon":
+			sub_name, sub_names = "MakerNote", canon_names
+		}
+		if sub_name == "" {
+			continue
+		}
+		sub, _, err := d.scanImageFileDirectory(sub_name, tag.Value, sub_names)
+		if err != nil {
+			sub = newIfd(sub_name)
+			sub.Err = err
+		}
+		d.SubIfds = append(d.SubIfds, sub)
+	}
+	return dir, t.Next, nil
+}
 
-	switch (t.Kind) {
+// scanMetaData scans all IFD directories and fetches all TIFF/EXIF tags
+func (d *decoder) scanMetaData() error {
+	offset := d.tiff.First
 
-	case KIND_STRING:
-		// move to string location and scan string
-		_, err = r.Seek(int64(t.Value), 0)
-		if err == nil {
-			s := bufio.NewReader(r)
-			v, err = s.ReadString(0)
-			if err == nil && len(v) > 0 {
-				v = v[:len(v) - 1]
-			}
+	// CR2 format includes 4 sections, each is composed of a
+	// header containing metadata and a picture.
+	//
+	// We only deal with the fourth picture, which has the highest
+	// resolution (others are thumbnails designed for camera use).
+	for i := 0; i < 4; i++ {
+		if offset == 0 {
+			return FormatError(fmt.Sprintf("only %d IFDs", i))
+		}
+		dir, next, err := d.scanImageFileDirectory(fmt.Sprintf("IFD%d", i), offset, tiff.Names)
+		if err != nil {
+			return err
 		}
+		d.Ifds = append(d.Ifds, dir)
+		offset = next
+	}
 
-		return k, v, err
+	return nil
+}
 
-	default:
-		v = fmt.Sprintf("%d", t.Value);
-		return k, v, err
-		
-	}
+// Raw contains the sensor data of a raw file: each pixel is a sample of
+// the color filter array, masked borders included.
+type Raw struct {
+	*image.Gray16
+	Bits         int             // significant bits of each sample
+	Active       image.Rectangle // area exposed to light
+	Shift        image.Point     // position of the first red sample of a RGGB pattern, relative to Active
+	Black        float64         // black level
+	White        float64         // saturation level
+	Model        string          // camera model
+	XYZCam       *[9]float64     // XYZ to camera matrix, nil if unknown
+	WhiteBalance [3]float64      // as shot red, green and blue multipliers, zeros if unknown
+}
 
-	return k, "UnknownValue", err
+// rawLayout describes how the sensor data is stored in the fourth image
+type rawLayout struct {
+	Section *io.SectionReader // lossless JPEG of the sensor data
+	Config  ljpeg.Config      // frame of the lossless JPEG
+	Slices  []int             // number of slices, their width and the width of the last one
+	Width   int               // dimensions of the sensor
+	Height  int
 }
 
-// scanImageFileEntry scans a tiff tag
-func (d decoder) scanImageFileEntry() error {
-	var tag tiffTag
-	err := binary.Read(d.buf, binary.LittleEndian, &tag)
+// scanRawLayout locates the lossless JPEG of the fourth image, which is
+// split in vertical slices (CR2Slices tag), without decoding it.
+func (d *decoder) scanRawLayout() (*rawLayout, error) {
+	if len(d.Ifds) < 4 {
+		return nil, FormatError("can't find raw image")
+	}
+	ifd := d.Ifds[3].Entries
+	res := &rawLayout{}
+	var err error
+	res.Section, err = d.section(d.Ifds[3], 0x0111, 0x0117)
+	if err != nil {
+		return nil, err
+	}
+	res.Config, err = ljpeg.DecodeConfig(res.Section)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	k, v, _ := tag.prettify(d.buf)
-	if err == nil {
-		d.Tags[k] = v
+	_, err = res.Section.Seek(0, 0)
+	if err != nil {
+		return nil, err
 	}
 
-	// recursively scan EXIF sub-directory
-	if k == "Exif" {
-		// backup current offset before reading in buffer
-		back, err := d.buf.Seek(0, 1)
+	res.Slices = []int{0, 0, 0}
+	if tag, ok := ifd[0xC640]; ok {
+		values, err := d.ushorts(tag)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		if len(values) != 3 {
+			return nil, FormatError("bad CR2Slices tag")
+		}
+		for i := range res.Slices {
+			res.Slices[i] = int(values[i])
+		}
+	}
 
-		d.buf.Seek(int64(tag.Value), 0)
-		d.scanImageFileDirectory()
-
-		// restore position
-		d.buf.Seek(back, 0)
+	// without slices, lines of the lossless JPEG are lines of the sensor
+	line := res.Config.Width * res.Config.Components
+	total := line * res.Config.Height
+	res.Width = line
+	if res.Slices[0] > 0 || res.Slices[2] > 0 {
+		// samples are laid out by the width of the slices
+		if (res.Slices[0] > 0 && res.Slices[1] == 0) || res.Slices[2] == 0 {
+			return nil, FormatError("bad CR2Slices tag")
+		}
+		res.Width = res.Slices[0]*res.Slices[1] + res.Slices[2]
+	}
+	if res.Width == 0 || total%res.Width != 0 {
+		return nil, FormatError("slices don't match the raw image")
 	}
+	res.Height = total / res.Width
 
-	return nil
+	return res, nil
 }
 
-// scanImageFileDirectory scans all tiff tags in an IFD
-func (d decoder) scanImageFileDirectory() error {
-	// get the number of entries of the IFD and skip those
-	var nb_entries uint16
-	err := binary.Read(d.buf, binary.LittleEndian, &nb_entries)
+// activeArea returns the area of a width*height sensor exposed to light.
+// Masked borders are on the left and top of the sensor, what's left has
+// the dimensions of the final image.
+func (d *decoder) activeArea(width int, height int) image.Rectangle {
+	if note := d.canonMakerNote(); note != nil && !note.SensorArea.Empty() {
+		if area := note.SensorArea; area.In(image.Rect(0, 0, width, height)) {
+			return area
+		}
+	}
+	w, err_w := strconv.Atoi(d.Tags["ExifImageWidth"])
+	h, err_h := strconv.Atoi(d.Tags["ExifImageHeight"])
+	if err_w == nil && err_h == nil && w > 0 && h > 0 && w <= width && h <= height {
+		return image.Rect(width-w, height-h, width, height)
+	}
+	return image.Rect(0, 0, width, height)
+}
+
+// scanRaw decodes the lossless JPEG of the fourth image and reassembles
+// its slices.
+func (d *decoder) scanRaw() (*Raw, error) {
+	layout, err := d.scanRawLayout()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for i := uint16(0); i < nb_entries; i++ {
-		err = d.scanImageFileEntry()
-		if err != nil {
-			return err
+	j, err := ljpeg.Decode(layout.Section)
+	if err != nil {
+		return nil, err
+	}
+	slices := layout.Slices
+	width := layout.Width
+	height := layout.Height
+
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for idx, v := range j.Pix {
+		row, col := idx/width, idx%width
+		if slices[0] > 0 || slices[2] > 0 {
+			// samples fill a slice from top to bottom, then the next one
+			i := 0
+			if slices[1] > 0 {
+				i = idx / (slices[1] * height)
+			}
+			last := 0
+			if i >= slices[0] {
+				i = slices[0]
+				last = 1
+			}
+			rest := idx - i*slices[1]*height
+			row = rest / slices[1+last]
+			col = rest%slices[1+last] + i*slices[1]
 		}
+		if row >= height || col >= width {
+			return nil, FormatError("slices don't match the raw image")
+		}
+		off := img.PixOffset(col, row)
+		img.Pix[off] = uint8(v >> 8)
+		img.Pix[off+1] = uint8(v)
 	}
 
-	return nil
+	res := &Raw{Gray16: img, Bits: j.Precision, Active: d.activeArea(width, height), Model: d.Tags["Model"]}
+	// the pattern of Canon sensors starts with a red sample
+	res.Shift = image.Pt(res.Active.Min.X&1, res.Active.Min.Y&1)
+	res.Black = blackLevel(img, res.Active)
+	res.White = whiteLevel(j.Precision)
+	res.lookupCamera()
+	if note := d.canonMakerNote(); note != nil {
+		res.WhiteBalance = note.WhiteBalance
+	}
+
+	return res, nil
 }
 
-// scanLossLessJPEG simply calls the jpeg decoder to return the lossless image
-func (d decoder) scanLossLessJPEG() (image.Image, error) {
-	v, ok := d.Tags["JPEGInterchangeFormat"]
-	if !ok {
-		return nil, errors.New("cr2: can't find jpeg image")
-	}
-	offset, err := strconv.Atoi(v)
+// DecodeRaw reads a CR2 image from r and returns its sensor data
+func DecodeRaw(r io.Reader) (*Raw, error) {
+	d, err := newDecoder(r)
 	if err != nil {
 		return nil, err
 	}
-	_, err = d.buf.Seek(int64(offset), 0)
+	return d.scanRaw()
+}
+
+// Decode reads a CR2 image from r and returns its sensor data developed
+// with the default options, as an *image.RGBA64.
+func Decode(r io.Reader) (image.Image, error) {
+	img, err := DecodeWithOptions(r, &DefaultDecodeOptions)
 	if err != nil {
 		return nil, err
 	}
-	return jpeg.Decode(d.buf)
+	return img, nil
 }
 
-// scanMetaData scans all IFD directories and fetches all TIFF/EXIF tags
-func (d decoder) scanMetaData() error {
-	// get the offset of the first IFD section and move there
-	var offset uint32
-	err := binary.Read(d.buf, binary.LittleEndian, &offset)
+// DecodeWithOptions reads a CR2 image from r and returns its sensor data
+// developed with the given options.
+func DecodeWithOptions(r io.Reader, opts *DecodeOptions) (*image.RGBA64, error) {
+	raw, err := DecodeRaw(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = d.buf.Seek(int64(offset), 0)
+	return raw.Develop(opts)
+}
+
+// config returns the color model and dimensions of the developed image
+func (d *decoder) config() (image.Config, error) {
+	layout, err := d.scanRawLayout()
 	if err != nil {
-		return err
+		return image.Config{}, err
 	}
+	active := d.activeArea(layout.Width, layout.Height)
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      active.Dx(),
+		Height:     active.Dy(),
+	}, nil
+}
 
-	// CR2 format includes 4 sections, each is composed of a
-	// header containing metadata and a picture.
-	//
-	// We only deal with the fourth picture, which has the highest
-	// resolution (others are thumbnails designed for camera use).
-	for i := 0; i < 4; i++ {
-		err = d.scanImageFileDirectory()
-		if err != nil {
-			return err
-		}
-		err = binary.Read(d.buf, binary.LittleEndian, &offset)
-		if err != nil {
-			return err
-		}
-		
-		_, err = d.buf.Seek(int64(offset), 0)
-		if err != nil {
-			return err
-		}
+// DecodeConfig returns the color model and dimensions of a CR2 image, as
+// returned by Decode, without decoding the sensor data
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return image.Config{}, err
 	}
+	return d.config()
+}
 
-	return nil
+// File is a CR2 file read on demand, so that only its IFDs and the images
+// asked for are loaded in memory
+type File struct {
+	d        *decoder
+	metadata *Metadata // built by the first call to Metadata
 }
 
-// Decode reads a CR2 image from r and returns it as an image.Image.
-// The type of Image returned depends on the PNG contents.
-func Decode(r io.Reader) (image.Image, error) {
-	buf, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
-	d := &decoder{bytes.NewReader(buf), make(map[string]string)}
-	err = d.scanHeader()
+// Open scans the tags of a CR2 file of size bytes, such as an *os.File,
+// without reading its images
+func Open(r io.ReaderAt, size int64) (*File, error) {
+	d, err := newDecoderAt(r, size)
 	if err != nil {
 		return nil, err
 	}
-	err = d.scanMetaData()
+	return &File{d: d}, nil
+}
+
+// Raw reads the sensor data of the file
+func (f *File) Raw() (*Raw, error) {
+	return f.d.scanRaw()
+}
+
+// Decode reads the sensor data of the file and develops it with the given
+// options
+func (f *File) Decode(opts *DecodeOptions) (*image.RGBA64, error) {
+	raw, err := f.Raw()
 	if err != nil {
 		return nil, err
 	}
-
-	// Now we can decode the JPEG section
-	return d.scanLossLessJPEG()
+	return raw.Develop(opts)
 }
 
-// DecodeConfig returns the color model and dimensions of a CR2 image
-func DecodeConfig(r io.Reader) (image.Config, error) {
-	return image.Config{}, errors.New("cr2: not yet (fully) implemented")
+// Config returns the color model and dimensions of the image returned by
+// Decode, without decoding the sensor data
+func (f *File) Config() (image.Config, error) {
+	return f.d.config()
 }
 
 func init() {
@@ -0,0 +1,37 @@
+package cr2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestOpenBadSubIfd(t *testing.T) {
+	data, err := os.ReadFile("testdata/small.cr2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the GPS IFD of the file points past its end
+	i := bytes.Index(data, []byte{0x25, 0x88, 4, 0, 1, 0, 0, 0})
+	if i < 0 {
+		t.Fatal("no GPSData tag")
+	}
+	binary.LittleEndian.PutUint32(data[i+8:], uint32(len(data)+16))
+
+	f, err := Open(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := f.Metadata()
+	if m.GPS != nil {
+		t.Errorf("got position %v from a bad GPS IFD", m.GPS)
+	}
+	dir := m.Directory("GPS")
+	if dir == nil || dir.Err == nil {
+		t.Fatalf("got GPS directory %v, want one with an error", dir)
+	}
+	if m.Directory("Exif") == nil || m.Directory("Exif").Err != nil {
+		t.Error("the Exif IFD wasn't kept")
+	}
+}
@@ -0,0 +1,324 @@
+package cr2
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/aimxhaisse/kodama/srgb"
+)
+
+// available demosaicing algorithms
+const (
+	DEMOSAIC_BILINEAR = iota // average of the closest samples of each color
+	DEMOSAIC_AHD             // adaptive homogeneity-directed (Hirakawa & Parks)
+)
+
+// DecodeOptions describes how the sensor data is developed to an RGB image
+type DecodeOptions struct {
+	Demosaic         int         // demosaicing algorithm
+	WhiteBalance     [3]float64  // red, green and blue multipliers, zeros for the camera's ones
+	AutoWhiteBalance bool        // estimate the white balance from the image instead of using the camera's one
+	Matrix           *[9]float64 // camera to linear sRGB matrix, nil to use the camera's one
+	Black            float64     // black level, zero to use the one of the raw
+	White            float64     // saturation level, zero to use the one of the raw
+}
+
+// DefaultDecodeOptions are used to develop images decoded by Decode
+var DefaultDecodeOptions = DecodeOptions{
+	Demosaic: DEMOSAIC_AHD,
+}
+
+// camera describes how to develop the sensor data of a camera model
+type camera struct {
+	White  float64    // saturation level
+	XYZCam [9]float64 // XYZ to camera matrix, times 10000
+}
+
+// lookupCamera sets the levels and color matrix of known camera models
+func (r *Raw) lookupCamera() {
+	cam, ok := cameras[r.Model]
+	if !ok {
+		return
+	}
+	if cam.White > r.Black {
+		r.White = cam.White
+	}
+	var xyz_cam [9]float64
+	for i := range xyz_cam {
+		xyz_cam[i] = cam.XYZCam[i] / 10000
+	}
+	r.XYZCam = &xyz_cam
+}
+
+// known cameras, by model (from dcraw's adobe_coeff table)
+var cameras = map[string]camera{
+	"Canon EOS 650D":      {0x3c82, [9]float64{6602, -841, -939, -4472, 12458, 2247, -975, 2039, 6148}},
+	"Canon EOS REBEL T4i": {0x3c82, [9]float64{6602, -841, -939, -4472, 12458, 2247, -975, 2039, 6148}},
+	"Canon EOS Kiss X6i":  {0x3c82, [9]float64{6602, -841, -939, -4472, 12458, 2247, -975, 2039, 6148}},
+}
+
+// linear sRGB (D65) to XYZ matrix
+var xyzRGB = [9]float64{
+	0.412453, 0.357580, 0.180423,
+	0.212671, 0.715160, 0.072169,
+	0.019334, 0.119193, 0.950227,
+}
+
+// multiply returns the product of two 3x3 matrices
+func multiply(a, b [9]float64) [9]float64 {
+	var res [9]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				res[i*3+j] += a[i*3+k] * b[k*3+j]
+			}
+		}
+	}
+	return res
+}
+
+// invert returns the inverse of a 3x3 matrix
+func invert(m [9]float64) ([9]float64, error) {
+	det := m[0]*(m[4]*m[8]-m[5]*m[7]) - m[1]*(m[3]*m[8]-m[5]*m[6]) + m[2]*(m[3]*m[7]-m[4]*m[6])
+	if math.Abs(det) < 1e-12 {
+		return m, errors.New("cr2: color matrix is not invertible")
+	}
+	return [9]float64{
+		(m[4]*m[8] - m[5]*m[7]) / det,
+		(m[2]*m[7] - m[1]*m[8]) / det,
+		(m[1]*m[5] - m[2]*m[4]) / det,
+		(m[5]*m[6] - m[3]*m[8]) / det,
+		(m[0]*m[8] - m[2]*m[6]) / det,
+		(m[2]*m[3] - m[0]*m[5]) / det,
+		(m[3]*m[7] - m[4]*m[6]) / det,
+		(m[1]*m[6] - m[0]*m[7]) / det,
+		(m[0]*m[4] - m[1]*m[3]) / det,
+	}, nil
+}
+
+// cameraMatrix returns the camera to linear sRGB matrix from an XYZ to
+// camera one, rows are normalized so that white stays white
+func cameraMatrix(xyz_cam [9]float64) ([9]float64, error) {
+	cam_rgb := multiply(xyz_cam, xyzRGB)
+	for i := 0; i < 3; i++ {
+		sum := cam_rgb[i*3] + cam_rgb[i*3+1] + cam_rgb[i*3+2]
+		if sum == 0 {
+			return cam_rgb, errors.New("cr2: invalid color matrix")
+		}
+		for j := 0; j < 3; j++ {
+			cam_rgb[i*3+j] /= sum
+		}
+	}
+	return invert(cam_rgb)
+}
+
+// cfaColor returns the color (0 for red, 1 for green, 2 for blue) of the
+// sample at (x, y) of a RGGB pattern
+func cfaColor(x int, y int) int {
+	return (y & 1) + (x & 1)
+}
+
+// mirror reflects a coordinate in [0, size), preserving its parity
+func mirror(i int, size int) int {
+	if i < 0 {
+		i = -i
+	}
+	if i >= size {
+		i = 2*(size-1) - i
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// cfa is the color filter array of the active area, normalized in [0, 1]
+type cfa struct {
+	Width  int
+	Height int
+	Pix    []float32
+	Shift  image.Point // position of the first red sample
+}
+
+// color returns the color of the sample at (x, y)
+func (c *cfa) color(x int, y int) int {
+	return cfaColor(x+c.Shift.X, y+c.Shift.Y)
+}
+
+// at returns the sample at (x, y), mirrored at the borders
+func (c *cfa) at(x int, y int) float32 {
+	return c.Pix[mirror(y, c.Height)*c.Width+mirror(x, c.Width)]
+}
+
+// levels returns the black and saturation levels
+func (r *Raw) levels(opts *DecodeOptions) (float64, float64) {
+	black := r.Black
+	white := r.White
+	if opts.Black > 0 {
+		black = opts.Black
+	}
+	if opts.White > 0 {
+		white = opts.White
+	}
+	return black, white
+}
+
+// normalize returns the active area with levels scaled to [0, 1]
+func (r *Raw) normalize(black float64, white float64) *cfa {
+	a := r.Active
+	res := &cfa{a.Dx(), a.Dy(), make([]float32, a.Dx()*a.Dy()), r.Shift}
+	scale := 1 / (white - black)
+	for y := 0; y < res.Height; y++ {
+		for x := 0; x < res.Width; x++ {
+			off := r.PixOffset(a.Min.X+x, a.Min.Y+y)
+			v := float64(uint16(r.Pix[off])<<8|uint16(r.Pix[off+1])) - black
+			res.Pix[y*res.Width+x] = float32(math.Max(0, math.Min(1, v*scale)))
+		}
+	}
+	return res
+}
+
+// autoWhiteBalance returns multipliers so that the average color is grey
+func autoWhiteBalance(c *cfa) [3]float64 {
+	var sum [3]float64
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			sum[c.color(x, y)] += float64(c.Pix[y*c.Width+x])
+		}
+	}
+	// there are twice more green samples
+	sum[1] /= 2
+	res := [3]float64{1, 1, 1}
+	for i := range sum {
+		if sum[i] > 0 {
+			res[i] = sum[1] / sum[i]
+		}
+	}
+	return res
+}
+
+// whiteBalance scales each color of the array, clipping saturated samples
+func (c *cfa) whiteBalance(mul [3]float64) {
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			i := y*c.Width + x
+			c.Pix[i] = float32(math.Min(1, float64(c.Pix[i])*mul[c.color(x, y)]))
+		}
+	}
+}
+
+// demosaicBilinear interpolates missing colors by averaging the closest
+// samples of each color, and returns interleaved RGB values
+func demosaicBilinear(c *cfa) []float32 {
+	res := make([]float32, c.Width*c.Height*3)
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			var sum [3]float32
+			var n [3]float32
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					sx, sy := mirror(x+dx, c.Width), mirror(y+dy, c.Height)
+					col := c.color(sx, sy)
+					sum[col] += c.Pix[sy*c.Width+sx]
+					n[col]++
+				}
+			}
+			out := res[(y*c.Width+x)*3:]
+			for i := 0; i < 3; i++ {
+				out[i] = sum[i] / n[i]
+			}
+			out[c.color(x, y)] = c.Pix[y*c.Width+x]
+		}
+	}
+	return res
+}
+
+// whiteLevel estimates the saturation level when the camera is unknown
+func whiteLevel(bits int) float64 {
+	return float64(int(1)<<uint(bits) - 1)
+}
+
+// blackLevel estimates the black level from the masked left border
+func blackLevel(img *image.Gray16, active image.Rectangle) float64 {
+	if active.Min.X < 4 {
+		return 0
+	}
+	samples := []int{}
+	for y := active.Min.Y; y < active.Max.Y; y++ {
+		// the first columns of the border are sometimes noisy
+		for x := 2; x < active.Min.X-2; x++ {
+			samples = append(samples, int(img.Gray16At(x, y).Y))
+		}
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Ints(samples)
+	return float64(samples[len(samples)/2])
+}
+
+// Develop converts the sensor data to a 16 bits sRGB image of the active area
+func (r *Raw) Develop(opts *DecodeOptions) (*image.RGBA64, error) {
+	if opts == nil {
+		opts = &DefaultDecodeOptions
+	}
+	if r.Active.Empty() {
+		return nil, errors.New("cr2: empty active area")
+	}
+
+	black, white := r.levels(opts)
+	if white <= black {
+		return nil, errors.New(fmt.Sprintf("cr2: invalid levels (black=%g, white=%g)", black, white))
+	}
+	c := r.normalize(black, white)
+
+	mul := opts.WhiteBalance
+	if mul[0] <= 0 || mul[1] <= 0 || mul[2] <= 0 {
+		mul = r.WhiteBalance
+		if opts.AutoWhiteBalance || mul[0] <= 0 || mul[1] <= 0 || mul[2] <= 0 {
+			mul = autoWhiteBalance(c)
+		}
+	}
+	c.whiteBalance([3]float64{mul[0] / mul[1], 1, mul[2] / mul[1]})
+
+	var rgb []float32
+	switch opts.Demosaic {
+	case DEMOSAIC_BILINEAR:
+		rgb = demosaicBilinear(c)
+	case DEMOSAIC_AHD:
+		rgb = demosaicAHD(c)
+	default:
+		return nil, errors.New(fmt.Sprintf("cr2: unknown demosaicing algorithm %d", opts.Demosaic))
+	}
+
+	matrix := [9]float64{1, 0, 0, 0, 1, 0, 0, 0, 1}
+	if opts.Matrix != nil {
+		matrix = *opts.Matrix
+	} else if r.XYZCam != nil {
+		var err error
+		matrix, err = cameraMatrix(*r.XYZCam)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := image.NewRGBA64(image.Rect(0, 0, c.Width, c.Height))
+	for y := 0; y < c.Height; y++ {
+		for x := 0; x < c.Width; x++ {
+			in := rgb[(y*c.Width+x)*3:]
+			off := out.PixOffset(x, y)
+			for i := 0; i < 3; i++ {
+				v := matrix[i*3]*float64(in[0]) + matrix[i*3+1]*float64(in[1]) + matrix[i*3+2]*float64(in[2])
+				s := srgb.FromLinear(uint16(math.Max(0, math.Min(1, v))*0xFFFF + 0.5))
+				out.Pix[off+2*i] = uint8(s >> 8)
+				out.Pix[off+2*i+1] = uint8(s)
+			}
+			out.Pix[off+6] = 0xFF
+			out.Pix[off+7] = 0xFF
+		}
+	}
+	return out, nil
+}
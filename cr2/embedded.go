@@ -0,0 +1,177 @@
+package cr2
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+
+	"github.com/aimxhaisse/kodama/tiff"
+)
+
+// images embedded in a CR2 file, one per IFD
+const (
+	IMAGE_PREVIEW   = iota // full size JPEG
+	IMAGE_THUMBNAIL        // small JPEG (160x120)
+	IMAGE_RGB              // small uncompressed 16 bits RGB image
+	IMAGE_RAW              // sensor data
+)
+
+// EmbeddedImages are the names of the embedded images, by index
+var EmbeddedImages = []string{"preview", "thumbnail", "rgb", "raw"}
+
+// tagValue returns the first value of an integer tag of an IFD
+func (d *decoder) tagValue(dir *ifd, id uint16) (uint32, error) {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return 0, FormatError(fmt.Sprintf("missing tag %s in %s", tiff.Name(id), dir.Name))
+	}
+	return d.tiff.Uint(tag)
+}
+
+// section returns the data pointed by an offset and a size tags of an IFD
+func (d *decoder) section(dir *ifd, offset_id uint16, size_id uint16) (*io.SectionReader, error) {
+	offset, err := d.tagValue(dir, offset_id)
+	if err != nil {
+		return nil, err
+	}
+	size, err := d.tagValue(dir, size_id)
+	if err != nil {
+		return nil, err
+	}
+	if !d.tiff.Contains(int64(offset), int64(size)) {
+		return nil, FormatError(fmt.Sprintf("%s of %s is out of the file", tiff.Name(offset_id), dir.Name))
+	}
+	return io.NewSectionReader(d.r, int64(offset), int64(size)), nil
+}
+
+// scanJPEG locates the JPEG of the preview (first IFD, as a strip) or the
+// thumbnail (second IFD, as a JPEG interchange format)
+func (d *decoder) scanJPEG(which int) (*io.SectionReader, error) {
+	if which != IMAGE_PREVIEW && which != IMAGE_THUMBNAIL {
+		return nil, errors.New(fmt.Sprintf("cr2: embedded image %d is not a JPEG", which))
+	}
+	if len(d.Ifds) <= which {
+		return nil, FormatError(fmt.Sprintf("can't find %s image", EmbeddedImages[which]))
+	}
+	if which == IMAGE_PREVIEW {
+		return d.section(d.Ifds[0], 0x0111, 0x0117)
+	}
+	return d.section(d.Ifds[1], 0x0201, 0x0202)
+}
+
+// scanRGB decodes the uncompressed image of the third IFD
+func (d *decoder) scanRGB() (image.Image, error) {
+	if len(d.Ifds) <= IMAGE_RGB {
+		return nil, FormatError("can't find rgb image")
+	}
+	dir := d.Ifds[IMAGE_RGB]
+	width, err := d.tagValue(dir, 0x0100)
+	if err != nil {
+		return nil, err
+	}
+	height, err := d.tagValue(dir, 0x0101)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := d.tagValue(dir, 0x0102)
+	if err != nil {
+		return nil, err
+	}
+	if bits != 16 {
+		return nil, UnsupportedError(fmt.Sprintf("rgb image of %d bits", bits))
+	}
+	section, err := d.section(dir, 0x0111, 0x0117)
+	if err != nil {
+		return nil, err
+	}
+	if int64(width)*int64(height)*6 > section.Size() {
+		return nil, FormatError("rgb image larger than its strip")
+	}
+	img := image.NewRGBA64(image.Rect(0, 0, int(width), int(height)))
+	raw := make([]byte, 6*int(width)*int(height))
+	_, err = io.ReadFull(section, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	// samples are little endian, the image is big endian
+	for i := 0; i < len(raw)/6; i++ {
+		out := img.Pix[8*i:]
+		for c := 0; c < 3; c++ {
+			out[2*c] = raw[6*i+2*c+1]
+			out[2*c+1] = raw[6*i+2*c]
+		}
+		out[6] = 0xFF
+		out[7] = 0xFF
+	}
+	return img, nil
+}
+
+// extractJPEG returns the JPEG file of the preview or the thumbnail
+func (d *decoder) extractJPEG(which int) ([]byte, error) {
+	section, err := d.scanJPEG(which)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(section)
+}
+
+// embedded decodes one of the embedded images
+func (d *decoder) embedded(which int) (image.Image, error) {
+	switch which {
+	case IMAGE_PREVIEW, IMAGE_THUMBNAIL:
+		section, err := d.scanJPEG(which)
+		if err != nil {
+			return nil, err
+		}
+		return jpeg.Decode(section)
+	case IMAGE_RGB:
+		return d.scanRGB()
+	case IMAGE_RAW:
+		raw, err := d.scanRaw()
+		if err != nil {
+			return nil, err
+		}
+		img, err := raw.Develop(&DefaultDecodeOptions)
+		if err != nil {
+			return nil, err
+		}
+		return img, nil
+	}
+	return nil, errors.New(fmt.Sprintf("cr2: unknown embedded image %d", which))
+}
+
+// ExtractJPEG returns the JPEG file of the preview or the thumbnail of a
+// CR2 file, as stored in it
+func ExtractJPEG(r io.Reader, which int) ([]byte, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.extractJPEG(which)
+}
+
+// DecodeEmbedded reads a CR2 file from r and returns one of its embedded
+// images, the sensor data being developed with the default options
+func DecodeEmbedded(r io.Reader, which int) (image.Image, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.embedded(which)
+}
+
+// ExtractJPEG returns the JPEG file of the preview or the thumbnail, as
+// stored in the file
+func (f *File) ExtractJPEG(which int) ([]byte, error) {
+	return f.d.extractJPEG(which)
+}
+
+// Embedded returns one of the embedded images, the sensor data being
+// developed with the default options
+func (f *File) Embedded(which int) (image.Image, error) {
+	return f.d.embedded(which)
+}
@@ -0,0 +1,49 @@
+package cr2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// seed adds the files of testdata to the corpus of the fuzzers: a small
+// valid CR2 file and variants that used to crash the decoder
+func seed(f *testing.F) {
+	paths, err := filepath.Glob("testdata/*.cr2")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	seed(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		config, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		img, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		size := img.Bounds().Size()
+		if size.X != config.Width || size.Y != config.Height {
+			t.Errorf("decoded %v, config is %dx%d", size, config.Width, config.Height)
+		}
+	})
+}
+
+func FuzzDecodeConfig(f *testing.F) {
+	seed(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodeConfig(bytes.NewReader(data))
+	})
+}
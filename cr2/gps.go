@@ -0,0 +1,79 @@
+package cr2
+
+import (
+	"time"
+
+	"github.com/aimxhaisse/kodama/gps"
+	"github.com/aimxhaisse/kodama/tiff"
+)
+
+// known tags of the GPS IFD
+var gps_names = tiff.TagNames{
+	0x0000: "GPSVersionID",
+	0x0001: "GPSLatitudeRef",
+	0x0002: "GPSLatitude",
+	0x0003: "GPSLongitudeRef",
+	0x0004: "GPSLongitude",
+	0x0005: "GPSAltitudeRef",
+	0x0006: "GPSAltitude",
+	0x0007: "GPSTimeStamp",
+	0x0008: "GPSSatellites",
+	0x0009: "GPSStatus",
+	0x000A: "GPSMeasureMode",
+	0x000B: "GPSDOP",
+	0x000C: "GPSSpeedRef",
+	0x000D: "GPSSpeed",
+	0x0010: "GPSImgDirectionRef",
+	0x0011: "GPSImgDirection",
+	0x0012: "GPSMapDatum",
+	0x001D: "GPSDateStamp",
+}
+
+// degrees returns an angle given as degrees, minutes and seconds
+func (d *decoder) degrees(dir *ifd, id uint16) (float64, bool) {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return 0, false
+	}
+	v, err := d.tiff.Rationals(tag)
+	if err != nil || len(v) != 3 {
+		return 0, false
+	}
+	return v[0] + v[1]/60 + v[2]/3600, true
+}
+
+// position decodes the GPS IFD, nil if there is none or it has no position
+func (d *decoder) position() *gps.Position {
+	dir := d.subIfd("GPS")
+	if dir == nil {
+		return nil
+	}
+	res := &gps.Position{}
+	var ok_lat, ok_lon bool
+	res.Latitude, ok_lat = d.degrees(dir, 0x0002)
+	res.Longitude, ok_lon = d.degrees(dir, 0x0004)
+	if !ok_lat || !ok_lon {
+		return nil
+	}
+	if dir.Tags["GPSLatitudeRef"] == "S" {
+		res.Latitude = -res.Latitude
+	}
+	if dir.Tags["GPSLongitudeRef"] == "W" {
+		res.Longitude = -res.Longitude
+	}
+
+	res.Altitude = d.rational(dir, 0x0006)
+	if dir.Tags["GPSAltitudeRef"] == "1" {
+		res.Altitude = -res.Altitude
+	}
+
+	date, err := time.Parse("2006:01:02", dir.Tags["GPSDateStamp"])
+	if tag, ok := dir.Entries[0x0007]; ok && err == nil {
+		hms, err := d.tiff.Rationals(tag)
+		if err == nil && len(hms) == 3 {
+			seconds := hms[0]*3600 + hms[1]*60 + hms[2]
+			res.Time = date.Add(time.Duration(seconds * float64(time.Second)))
+		}
+	}
+	return res
+}
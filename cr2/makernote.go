@@ -0,0 +1,184 @@
+package cr2
+
+import (
+	"image"
+	"strings"
+
+	"github.com/aimxhaisse/kodama/tiff"
+)
+
+// known tags of Canon maker notes (from http://lclevy.free.fr/cr2 and
+// ExifTool), named so that they don't collide with tiff tags
+var canon_names = tiff.TagNames{
+	0x0001: "CanonCameraSettings",
+	0x0002: "CanonFocalLength",
+	0x0004: "CanonShotInfo",
+	0x0006: "CanonImageType",
+	0x0007: "CanonFirmwareVersion",
+	0x0009: "CanonOwnerName",
+	0x000C: "CanonSerialNumber",
+	0x0010: "CanonModelID",
+	0x0026: "CanonAFInfo2",
+	0x0093: "CanonFileInfo",
+	0x0095: "CanonLensModel",
+	0x0096: "CanonInternalSerialNumber",
+	0x00E0: "CanonSensorInfo",
+	0x4001: "CanonColorData",
+}
+
+// index of the as shot RGGB white balance levels in the color data, by
+// number of values of the tag (which depends on the camera generation)
+var colorDataWhiteBalance = map[uint32]int{
+	// ColorData1 to ColorData3
+	582: 25,
+	653: 34,
+	796: 63,
+	// ColorData4
+	674: 63, 692: 63, 702: 63, 1107: 63, 1227: 63, 1250: 63, 1251: 63, 1337: 63, 1338: 63, 1346: 63,
+	// ColorData5 (PowerShot)
+	5120: 71,
+	// ColorData6 to ColorData8
+	1273: 63, 1275: 63,
+	1312: 63, 1313: 63, 1316: 63, 1506: 63,
+	1560: 63, 1592: 63, 1353: 63, 1602: 63,
+	// ColorData9 to ColorData11
+	1816: 71, 1820: 71, 1824: 71,
+	2024: 85, 3656: 85,
+	3973: 105, 3778: 105,
+}
+
+// AFPoint is an autofocus point, in pixels of the image
+type AFPoint struct {
+	Rect     image.Rectangle
+	InFocus  bool
+	Selected bool
+}
+
+// CanonMakerNote contains the fields of a Canon maker note
+type CanonMakerNote struct {
+	ModelID         uint32
+	ImageType       string
+	FirmwareVersion string
+	OwnerName       string
+	SerialNumber    uint32
+	InternalSerial  string
+	LensType        int // lens id from the camera settings
+	LensModel       string
+	FileNumber      int
+	ShutterCount    int             // only recorded by EOS-1D models, zero otherwise
+	SensorArea      image.Rectangle // area of the sensor exposed to light, empty if unknown
+	WhiteBalance    [3]float64      // as shot red, green and blue multipliers, zeros if unknown
+	AFPoints        []AFPoint
+}
+
+// shorts returns the values of a tag of unsigned shorts of the maker note,
+// nil if missing
+func (d *decoder) shorts(dir *ifd, id uint16) []uint16 {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return nil
+	}
+	values, err := d.ushorts(tag)
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+// scanAFInfo decodes the autofocus points of the AFInfo2 tag
+func scanAFInfo(af []uint16) []AFPoint {
+	if len(af) < 8 {
+		return nil
+	}
+	n := int(af[2])
+	words := (n + 15) / 16
+	if n == 0 || len(af) < 8+4*n+words {
+		return nil
+	}
+	// positions are relative to the center of the image, y going up
+	width, height := int(af[6]), int(af[7])
+	res := make([]AFPoint, n)
+	for i := range res {
+		w, h := int(af[8+i]), int(af[8+n+i])
+		x := width/2 + int(int16(af[8+2*n+i]))
+		y := height/2 - int(int16(af[8+3*n+i]))
+		res[i].Rect = image.Rect(x-w/2, y-h/2, x-w/2+w, y-h/2+h)
+		res[i].InFocus = af[8+4*n+i/16]&(1<<uint(i%16)) != 0
+		if len(af) >= 8+4*n+2*words {
+			res[i].Selected = af[8+4*n+words+i/16]&(1<<uint(i%16)) != 0
+		}
+	}
+	return res
+}
+
+// scanColorData returns the as shot white balance multipliers
+func scanColorData(tag tiff.Tag, data []uint16) [3]float64 {
+	idx, ok := colorDataWhiteBalance[tag.Nb]
+	if !ok || len(data) < idx+4 {
+		return [3]float64{}
+	}
+	// levels are stored as RGGB
+	r, g1, g2, b := float64(data[idx]), float64(data[idx+1]), float64(data[idx+2]), float64(data[idx+3])
+	g := (g1 + g2) / 2
+	if r == 0 || g == 0 || b == 0 {
+		return [3]float64{}
+	}
+	return [3]float64{r / g, 1, b / g}
+}
+
+// canonMakerNote decodes the Canon maker note, nil if there is none
+func (d *decoder) canonMakerNote() *CanonMakerNote {
+	dir := d.subIfd("MakerNote")
+	if dir == nil {
+		return nil
+	}
+	res := &CanonMakerNote{}
+	res.ImageType = dir.Tags["CanonImageType"]
+	res.FirmwareVersion = dir.Tags["CanonFirmwareVersion"]
+	res.OwnerName = dir.Tags["CanonOwnerName"]
+	res.InternalSerial = dir.Tags["CanonInternalSerialNumber"]
+	res.LensModel = dir.Tags["CanonLensModel"]
+	if tag, ok := dir.Entries[0x0010]; ok {
+		res.ModelID, _ = d.tiff.Uint(tag)
+	}
+	if tag, ok := dir.Entries[0x000C]; ok {
+		res.SerialNumber, _ = d.tiff.Uint(tag)
+	}
+
+	if settings := d.shorts(dir, 0x0001); len(settings) > 22 {
+		res.LensType = int(settings[22])
+	}
+
+	// the file number is replaced by the shutter count on EOS-1D models
+	if info := d.shorts(dir, 0x0093); len(info) > 2 {
+		v := int(info[1]) | int(info[2])<<16
+		if strings.Contains(d.model(), "1D") {
+			res.ShutterCount = v
+		} else {
+			res.FileNumber = v
+		}
+	}
+
+	// borders are inclusive
+	if sensor := d.shorts(dir, 0x00E0); len(sensor) > 8 {
+		area := image.Rect(int(sensor[5]), int(sensor[6]), int(sensor[7])+1, int(sensor[8])+1)
+		if area.Min.In(image.Rect(0, 0, int(sensor[1]), int(sensor[2]))) && !area.Empty() {
+			res.SensorArea = area
+		}
+	}
+
+	if tag, ok := dir.Entries[0x4001]; ok {
+		res.WhiteBalance = scanColorData(tag, d.shorts(dir, 0x4001))
+	}
+
+	res.AFPoints = scanAFInfo(d.shorts(dir, 0x0026))
+	return res
+}
+
+// model returns the camera model of the first IFD
+func (d *decoder) model() string {
+	if len(d.Ifds) == 0 {
+		return ""
+	}
+	return d.Ifds[0].Tags["Model"]
+}
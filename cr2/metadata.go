@@ -0,0 +1,154 @@
+package cr2
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/aimxhaisse/kodama/gps"
+)
+
+// DATE_LAYOUT is the layout of the dates in tiff tags
+const DATE_LAYOUT = "2006:01:02 15:04:05"
+
+// Directory contains the tags of an IFD, by name
+type Directory struct {
+	Name  string            // IFD0 to IFD3 for the four images, Exif, GPS or MakerNote for sub-IFDs
+	Tags  map[string]string // prettified values of the tags
+	Names []string          // names of the tags, in file order
+	Err   error             // why the IFD can't be read, its tags being then missing
+}
+
+// Metadata describes the shot of a CR2 file
+type Metadata struct {
+	Make             string
+	Model            string
+	SerialNumber     string
+	OwnerName        string
+	Artist           string
+	Copyright        string
+	LensModel        string
+	LensSerialNumber string
+
+	ISO                  int
+	ExposureTime         float64 // in seconds
+	FNumber              float64
+	FocalLength          float64 // in millimeters
+	ExposureCompensation float64 // in EV
+
+	DateTime         time.Time // last modification
+	DateTimeOriginal time.Time // shot
+	CreateDate       time.Time // digitization
+
+	Orientation int // tiff orientation, 1 for none
+	Width       int // dimensions of the developed image
+	Height      int
+
+	XMP   []byte          // XMP packet, nil if the file has none
+	GPS   *gps.Position   // nil if the file has no position
+	Canon *CanonMakerNote // nil if the file has no Canon maker note
+
+	Directories []*Directory // IFDs of the four images, then sub-IFDs
+}
+
+// Directory returns the IFD called name, or nil
+func (m *Metadata) Directory(name string) *Directory {
+	for _, dir := range m.Directories {
+		if dir.Name == name {
+			return dir
+		}
+	}
+	return nil
+}
+
+// rational returns the first rational of a tag, zero if missing or invalid
+func (d *decoder) rational(dir *ifd, id uint16) float64 {
+	if dir == nil {
+		return 0
+	}
+	tag, ok := dir.Entries[id]
+	if !ok || tag.Nb == 0 {
+		return 0
+	}
+	values, err := d.tiff.Rationals(tag)
+	if err != nil {
+		return 0
+	}
+	return values[0]
+}
+
+// subIfd returns the sub-IFD called name, or nil if it is missing or
+// can't be read
+func (d *decoder) subIfd(name string) *ifd {
+	for _, dir := range d.SubIfds {
+		if dir.Name == name && dir.Err == nil {
+			return dir
+		}
+	}
+	return nil
+}
+
+// metadata builds the description of the shot from the scanned IFDs
+func (d *decoder) metadata() *Metadata {
+	res := &Metadata{}
+	ifd0 := newIfd("IFD0")
+	if len(d.Ifds) > 0 {
+		ifd0 = d.Ifds[0]
+	}
+	exif := d.subIfd("Exif")
+	if exif == nil {
+		exif = newIfd("Exif")
+	}
+
+	res.Make = ifd0.Tags["Maker"]
+	res.Model = ifd0.Tags["Model"]
+	res.Artist = ifd0.Tags["Artist"]
+	res.Copyright = ifd0.Tags["Copyright"]
+	res.SerialNumber = exif.Tags["SerialNumber"]
+	res.OwnerName = exif.Tags["OwnerName"]
+	res.LensModel = exif.Tags["LensModel"]
+	res.LensSerialNumber = exif.Tags["LensSerialNumber"]
+
+	res.ISO, _ = strconv.Atoi(exif.Tags["ISOSpeedRatings"])
+	res.ExposureTime = d.rational(exif, 0x829A)
+	res.FNumber = d.rational(exif, 0x829D)
+	res.FocalLength = d.rational(exif, 0x920A)
+	res.ExposureCompensation = d.rational(exif, 0x9204)
+
+	res.DateTime, _ = time.Parse(DATE_LAYOUT, ifd0.Tags["DateTime"])
+	res.DateTimeOriginal, _ = time.Parse(DATE_LAYOUT, exif.Tags["DateTimeOriginal"])
+	res.CreateDate, _ = time.Parse(DATE_LAYOUT, exif.Tags["CreateDate"])
+
+	res.Orientation, _ = strconv.Atoi(ifd0.Tags["Orientation"])
+	res.Width, _ = strconv.Atoi(exif.Tags["ExifImageWidth"])
+	res.Height, _ = strconv.Atoi(exif.Tags["ExifImageHeight"])
+
+	if tag, ok := ifd0.Entries[0x02BC]; ok {
+		res.XMP, _ = d.tiff.Data(tag)
+	}
+	res.GPS = d.position()
+	res.Canon = d.canonMakerNote()
+
+	for _, dir := range append(append([]*ifd{}, d.Ifds...), d.SubIfds...) {
+		res.Directories = append(res.Directories, &Directory{dir.Name, dir.Tags, dir.Names, dir.Err})
+	}
+	return res
+}
+
+// DecodeMetadata reads the tags of a CR2 file from r, without decoding
+// its images
+func DecodeMetadata(r io.Reader) (*Metadata, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.metadata(), nil
+}
+
+// Metadata returns the tags of the file, built once
+func (f *File) Metadata() *Metadata {
+	if f.metadata == nil {
+		f.metadata = f.d.metadata()
+	}
+	return f.metadata
+}
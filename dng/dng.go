@@ -0,0 +1,546 @@
+// Package dng implements a decoder for Digital Negative (DNG) raw images
+// made with a Bayer color filter array, either uncompressed or compressed
+// with lossless JPEG. Sensor data is developed by the cr2 package.
+package dng
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/ljpeg"
+	"github.com/aimxhaisse/kodama/tiff"
+)
+
+// A FormatError reports that the input is not a valid DNG image
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "dng: invalid format: " + string(e)
+}
+
+// An UnsupportedError reports that the input uses a valid but unimplemented feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "dng: unsupported feature: " + string(e)
+}
+
+// values of the PhotometricInterpretation tag
+const (
+	PHOTOMETRIC_CFA        = 32803
+	PHOTOMETRIC_LINEAR_RAW = 34892
+)
+
+// values of the Compression tag
+const (
+	COMPRESSION_NONE  = 1
+	COMPRESSION_LJPEG = 7
+)
+
+// values of the CalibrationIlluminant tags
+const (
+	ILLUMINANT_D65 = 21
+)
+
+// errNotDNG reports a tiff file which isn't a DNG
+var errNotDNG = FormatError("missing DNGVersion tag")
+
+// decoder is the internal representation of a DNG file
+type decoder struct {
+	r    io.ReaderAt
+	tiff *tiff.Reader
+	ifd0 *tiff.IFD // camera description
+	raw  *tiff.IFD // full resolution sensor data
+}
+
+// newDecoder reads a DNG file and locates its sensor data
+func newDecoder(r io.Reader) (*decoder, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &decoder{r: bytes.NewReader(buf)}
+	d.tiff, err = tiff.NewReader(d.r, int64(len(buf)))
+	if err != nil {
+		return nil, FormatError("not a tiff file")
+	}
+	d.ifd0, err = d.tiff.ReadIFD(d.tiff.First)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := d.ifd0.Entries[0xC612]; !ok {
+		return nil, errNotDNG
+	}
+	d.raw, err = d.findRaw()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// findRaw returns the IFD of the full resolution image, which is either
+// IFD0 or one of its sub-IFDs (IFD0 being then a preview)
+func (d *decoder) findRaw() (*tiff.IFD, error) {
+	candidates := []*tiff.IFD{d.ifd0}
+	if tag, ok := d.ifd0.Entries[0x014A]; ok {
+		offsets, err := d.tiff.Uints(tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, offset := range offsets {
+			sub, err := d.tiff.ReadIFD(offset)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, sub)
+		}
+	}
+	for _, dir := range candidates {
+		if d.uint(dir, 0x00FE, 0) != 0 {
+			continue
+		}
+		switch d.uint(dir, 0x0106, 0) {
+		case PHOTOMETRIC_CFA:
+			return dir, nil
+		case PHOTOMETRIC_LINEAR_RAW:
+			return nil, UnsupportedError("linear raw images")
+		}
+	}
+	return nil, FormatError("can't find raw image")
+}
+
+// uint returns the first value of an integer tag, or def if missing
+func (d *decoder) uint(dir *tiff.IFD, id uint16, def uint32) uint32 {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return def
+	}
+	v, err := d.tiff.Uint(tag)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// floats returns the values of a numeric tag, or nil if missing
+func (d *decoder) floats(dir *tiff.IFD, id uint16) []float64 {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return nil
+	}
+	v, err := d.tiff.Floats(tag)
+	if err != nil {
+		return nil
+	}
+	return v
+}
+
+// uints returns the values of an integer tag, which must be present
+func (d *decoder) uints(dir *tiff.IFD, id uint16) ([]uint32, error) {
+	tag, ok := dir.Entries[id]
+	if !ok {
+		return nil, FormatError(fmt.Sprintf("missing %s tag", tiff.Name(id)))
+	}
+	return d.tiff.Uints(tag)
+}
+
+// tile is a rectangle of the image stored at once
+type tile struct {
+	Offset int64
+	Size   int64
+	Bounds image.Rectangle
+}
+
+// scanTiles returns the tiles of the raw image, strips being tiles as
+// wide as the image
+func (d *decoder) scanTiles(width int, height int) ([]tile, error) {
+	var offsets, sizes []uint32
+	var err error
+	tw, th := width, height
+	_, tiled := d.raw.Entries[0x0144]
+	if tiled {
+		tw = int(d.uint(d.raw, 0x0142, 0))
+		th = int(d.uint(d.raw, 0x0143, 0))
+		offsets, err = d.uints(d.raw, 0x0144)
+		if err != nil {
+			return nil, err
+		}
+		sizes, err = d.uints(d.raw, 0x0145)
+	} else {
+		th = int(d.uint(d.raw, 0x0116, uint32(height)))
+		offsets, err = d.uints(d.raw, 0x0111)
+		if err != nil {
+			return nil, err
+		}
+		sizes, err = d.uints(d.raw, 0x0117)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tw <= 0 || th <= 0 || len(offsets) != len(sizes) {
+		return nil, FormatError("bad tiles or strips")
+	}
+	// a single strip can be declared with a huge RowsPerStrip, while tiles
+	// are only padded to a multiple of 16 pixels and hold at least one bit
+	// per sample
+	if !tiled && th > height {
+		th = height
+	}
+	if int64(tw) > int64(width)+15 || int64(th) > int64(height)+15 || int64(tw)*int64(th) > 8*d.tiff.Size {
+		return nil, FormatError("tiles larger than the image")
+	}
+	across := (width + tw - 1) / tw
+	if len(offsets) < across*((height+th-1)/th) {
+		return nil, FormatError("missing tiles or strips")
+	}
+	res := []tile{}
+	for i := range offsets {
+		x, y := (i%across)*tw, (i/across)*th
+		bounds := image.Rect(x, y, x+tw, y+th)
+		if !tiled {
+			// the last strip only holds the remaining rows
+			bounds = bounds.Intersect(image.Rect(0, 0, width, height))
+		}
+		if !d.tiff.Contains(int64(offsets[i]), int64(sizes[i])) {
+			return nil, FormatError("tile or strip out of the file")
+		}
+		res = append(res, tile{int64(offsets[i]), int64(sizes[i]), bounds})
+	}
+	return res, nil
+}
+
+// decodeTile decodes the samples of a tile, returned row by row
+func (d *decoder) decodeTile(t tile, compression uint32, bits int) ([]uint16, int, error) {
+	section := io.NewSectionReader(d.r, t.Offset, t.Size)
+	switch compression {
+
+	case COMPRESSION_NONE:
+		raw := make([]byte, t.Size)
+		_, err := io.ReadFull(section, raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		return d.unpack(raw, t.Bounds.Dx(), t.Bounds.Dy(), bits)
+
+	case COMPRESSION_LJPEG:
+		j, err := ljpeg.Decode(section)
+		if err != nil {
+			return nil, 0, err
+		}
+		return j.Pix, j.Width * j.Components, nil
+
+	}
+	return nil, 0, UnsupportedError(fmt.Sprintf("compression %d", compression))
+}
+
+// unpack returns the samples of an uncompressed tile, rows start on a
+// byte boundary and samples of other than 8 or 16 bits are packed with
+// the most significant bits first
+func (d *decoder) unpack(raw []byte, width int, height int, bits int) ([]uint16, int, error) {
+	line := (int64(width)*int64(bits) + 7) / 8
+	if int64(len(raw)) < line*int64(height) {
+		return nil, 0, FormatError("short tile or strip")
+	}
+	res := make([]uint16, width*height)
+	for y := 0; y < height; y++ {
+		row := raw[int64(y)*line : int64(y+1)*line]
+		for x := 0; x < width; x++ {
+			var v uint16
+			switch bits {
+			case 8:
+				v = uint16(row[x])
+			case 16:
+				v = d.tiff.Order.Uint16(row[2*x:])
+			default:
+				pos := x * bits
+				acc := uint32(0)
+				for n := 0; n < bits; n++ {
+					b := pos + n
+					acc = acc<<1 | uint32(row[b/8]>>uint(7-b%8)&1)
+				}
+				v = uint16(acc)
+			}
+			res[y*width+x] = v
+		}
+	}
+	return res, width, nil
+}
+
+// scanSensor decodes the samples of the raw image
+func (d *decoder) scanSensor() (*image.Gray16, int, error) {
+	width := int(d.uint(d.raw, 0x0100, 0))
+	height := int(d.uint(d.raw, 0x0101, 0))
+	bits := int(d.uint(d.raw, 0x0102, 16))
+	// samples take at least one bit, compressed or not
+	if width <= 0 || height <= 0 || int64(width)*int64(height) > 8*d.tiff.Size {
+		return nil, 0, FormatError("bad dimensions")
+	}
+	if bits < 1 || bits > 16 {
+		return nil, 0, UnsupportedError(fmt.Sprintf("%d bits samples", bits))
+	}
+	if d.uint(d.raw, 0x0115, 1) != 1 {
+		return nil, 0, UnsupportedError("several samples per pixel")
+	}
+	compression := d.uint(d.raw, 0x0103, COMPRESSION_NONE)
+	tiles, err := d.scanTiles(width, height)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var table []uint32
+	if tag, ok := d.raw.Entries[0xC618]; ok {
+		table, err = d.tiff.Uints(tag)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	img := image.NewGray16(image.Rect(0, 0, width, height))
+	for _, t := range tiles {
+		pix, line, err := d.decodeTile(t, compression, bits)
+		if err != nil {
+			return nil, 0, err
+		}
+		if line <= 0 {
+			return nil, 0, FormatError("empty tile or strip")
+		}
+		for i, v := range pix {
+			x, y := t.Bounds.Min.X+i%line, t.Bounds.Min.Y+i/line
+			if x >= t.Bounds.Max.X || x >= width || y >= height {
+				continue
+			}
+			if len(table) > 0 {
+				v = uint16(table[int(math.Min(float64(v), float64(len(table)-1)))])
+			}
+			off := img.PixOffset(x, y)
+			img.Pix[off] = uint8(v >> 8)
+			img.Pix[off+1] = uint8(v)
+		}
+	}
+	return img, bits, nil
+}
+
+// activeArea returns the default crop of the image, and its offset in
+// the area exposed to light (ActiveArea tag)
+func (d *decoder) activeArea(width int, height int) (image.Rectangle, image.Point) {
+	area := image.Rect(0, 0, width, height)
+	if v := d.floats(d.raw, 0xC68D); len(v) == 4 {
+		area = image.Rect(int(v[1]), int(v[0]), int(v[3]), int(v[2])).Intersect(area)
+	}
+	origin := image.Point{}
+	if v := d.floats(d.raw, 0xC61F); len(v) == 2 {
+		origin = image.Pt(int(v[0]), int(v[1]))
+	}
+	crop := area.Sub(area.Min).Add(area.Min.Add(origin))
+	if v := d.floats(d.raw, 0xC620); len(v) == 2 {
+		crop.Max = crop.Min.Add(image.Pt(int(v[0]), int(v[1])))
+	}
+	return crop.Intersect(area), origin
+}
+
+// scanPattern returns the position of the red sample in the 2x2 CFA
+// pattern, which starts at the origin of the area exposed to light
+func (d *decoder) scanPattern() (image.Point, error) {
+	dims := d.floats(d.raw, 0x828D)
+	if len(dims) != 2 || dims[0] != 2 || dims[1] != 2 {
+		return image.Point{}, UnsupportedError("non 2x2 CFA patterns")
+	}
+	tag, ok := d.raw.Entries[0x828E]
+	if !ok {
+		return image.Point{}, FormatError("missing CFAPattern tag")
+	}
+	pattern, err := d.tiff.Data(tag)
+	if err != nil {
+		return image.Point{}, err
+	}
+	if len(pattern) != 4 {
+		return image.Point{}, FormatError("bad CFAPattern tag")
+	}
+	for i, c := range pattern {
+		if c != 0 {
+			continue
+		}
+		red := image.Pt(i%2, i/2)
+		blue := pattern[(1-red.Y)*2+1-red.X]
+		greens := pattern[red.Y*2+1-red.X] == 1 && pattern[(1-red.Y)*2+red.X] == 1
+		if blue == 2 && greens {
+			return red, nil
+		}
+	}
+	return image.Point{}, UnsupportedError(fmt.Sprintf("CFA pattern %v", pattern))
+}
+
+// colorMatrix returns the XYZ to camera matrix, preferably the one of
+// D65 light
+func (d *decoder) colorMatrix() *[9]float64 {
+	var res *[9]float64
+	for i, id := range []uint16{0xC621, 0xC622} {
+		m := d.floats(d.ifd0, id)
+		if len(m) != 9 {
+			continue
+		}
+		res = &[9]float64{}
+		copy(res[:], m)
+		if d.uint(d.ifd0, 0xC65A+uint16(i), 0) == ILLUMINANT_D65 {
+			break
+		}
+	}
+	return res
+}
+
+// scanRaw decodes the sensor data and its description
+func (d *decoder) scanRaw() (*cr2.Raw, error) {
+	img, bits, err := d.scanSensor()
+	if err != nil {
+		return nil, err
+	}
+	red, err := d.scanPattern()
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	active, origin := d.activeArea(b.Dx(), b.Dy())
+	if active.Empty() {
+		return nil, FormatError("empty active area")
+	}
+
+	res := &cr2.Raw{Gray16: img, Bits: bits, Active: active}
+	res.Shift = image.Pt((red.X-origin.X)&1, (red.Y-origin.Y)&1)
+	if v := d.floats(d.raw, 0xC61A); len(v) > 0 {
+		for _, black := range v {
+			res.Black += black / float64(len(v))
+		}
+	}
+	res.White = float64(int(1)<<uint(bits) - 1)
+	if v := d.floats(d.raw, 0xC61D); len(v) > 0 {
+		res.White = v[0]
+	}
+	res.XYZCam = d.colorMatrix()
+	if v := d.floats(d.ifd0, 0xC628); len(v) == 3 && v[0] > 0 && v[1] > 0 && v[2] > 0 {
+		res.WhiteBalance = [3]float64{1 / v[0], 1 / v[1], 1 / v[2]}
+	}
+	for _, id := range []uint16{0xC614, 0x0110} {
+		if tag, ok := d.ifd0.Entries[id]; ok {
+			res.Model, _ = d.tiff.Format(tag)
+			break
+		}
+	}
+	return res, nil
+}
+
+// ExposureTime reads the exposure time in seconds of a DNG file of the
+// given size, from IFD0 or its EXIF IFD, without reading the sensor data;
+// it is 0 if unknown
+func ExposureTime(r io.ReaderAt, size int64) (float64, error) {
+	t, err := tiff.NewReader(r, size)
+	if err != nil {
+		return 0, FormatError("not a tiff file")
+	}
+	ifd0, err := t.ReadIFD(t.First)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := ifd0.Entries[0xC612]; !ok {
+		return 0, errNotDNG
+	}
+	dirs := []*tiff.IFD{ifd0}
+	if tag, ok := ifd0.Entries[0x8769]; ok {
+		offset, err := t.Uint(tag)
+		if err != nil {
+			return 0, err
+		}
+		exif, err := t.ReadIFD(offset)
+		if err != nil {
+			return 0, err
+		}
+		dirs = append(dirs, exif)
+	}
+	for _, dir := range dirs {
+		if tag, ok := dir.Entries[0x829A]; ok {
+			v, err := t.Floats(tag)
+			if err != nil || len(v) == 0 {
+				return 0, err
+			}
+			return v[0], nil
+		}
+	}
+	return 0, nil
+}
+
+// DecodeRaw reads a DNG image from r and returns its sensor data
+func DecodeRaw(r io.Reader) (*cr2.Raw, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.scanRaw()
+}
+
+// Decode reads a DNG image from r and returns its sensor data developed
+// with the default options, as an *image.RGBA64.
+func Decode(r io.Reader) (image.Image, error) {
+	img, err := DecodeWithOptions(r, &cr2.DefaultDecodeOptions)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// DecodeWithOptions reads a DNG image from r and returns its sensor data
+// developed with the given options.
+func DecodeWithOptions(r io.Reader, opts *cr2.DecodeOptions) (*image.RGBA64, error) {
+	raw, err := DecodeRaw(r)
+	if err != nil {
+		return nil, err
+	}
+	return raw.Develop(opts)
+}
+
+// DecodeConfig returns the color model and dimensions of a DNG image, as
+// returned by Decode, without decoding the sensor data
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	d, err := newDecoder(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	width := int(d.uint(d.raw, 0x0100, 0))
+	height := int(d.uint(d.raw, 0x0101, 0))
+	active, _ := d.activeArea(width, height)
+	return image.Config{
+		ColorModel: color.RGBA64Model,
+		Width:      active.Dx(),
+		Height:     active.Dy(),
+	}, nil
+}
+
+// sniffed reports tiff files which aren't DNGs as an unknown format to
+// image.Decode, DNGs having no magic of their own
+func sniffed(err error) error {
+	if err == errNotDNG {
+		return image.ErrFormat
+	}
+	return err
+}
+
+// The format is registered with the magic of tiff files, which also
+// matches CR2 files: image.Decode tries formats in registration order, and
+// the cr2 format is always registered first since this package imports it.
+// Other tiff files are reported as image.ErrFormat.
+func init() {
+	decode := func(r io.Reader) (image.Image, error) {
+		img, err := Decode(r)
+		return img, sniffed(err)
+	}
+	decodeConfig := func(r io.Reader) (image.Config, error) {
+		config, err := DecodeConfig(r)
+		return config, sniffed(err)
+	}
+	image.RegisterFormat("dng", "II\x2a\x00", decode, decodeConfig)
+	image.RegisterFormat("dng", "MM\x00\x2a", decode, decodeConfig)
+}
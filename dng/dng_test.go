@@ -0,0 +1,149 @@
+package dng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/aimxhaisse/kodama/cr2"
+)
+
+// plainTIFF returns a tiff file with a single IFD holding ImageWidth,
+// followed by extra bytes
+func plainTIFF(order binary.ByteOrder, extra []byte) []byte {
+	buf := &bytes.Buffer{}
+	if order == binary.LittleEndian {
+		buf.WriteString("II")
+	} else {
+		buf.WriteString("MM")
+	}
+	binary.Write(buf, order, uint16(42))
+	binary.Write(buf, order, uint32(8+len(extra)))
+	buf.Write(extra)
+	binary.Write(buf, order, uint16(1))
+	binary.Write(buf, order, []uint16{0x0100, 3})
+	binary.Write(buf, order, []uint32{1, 64})
+	binary.Write(buf, order, uint32(0))
+	return buf.Bytes()
+}
+
+func TestDecodeConfigPlainTIFF(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		_, format, err := image.DecodeConfig(bytes.NewReader(plainTIFF(order, nil)))
+		if err != image.ErrFormat {
+			t.Errorf("%v: got format %q and error %v, want image.ErrFormat", order, format, err)
+		}
+		_, err = DecodeConfig(bytes.NewReader(plainTIFF(order, nil)))
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("%v: got error %v, want a FormatError", order, err)
+		}
+	}
+}
+
+func TestDecodeConfigCR2First(t *testing.T) {
+	// the CR2 header follows the tiff one, at offset 8
+	data := plainTIFF(binary.LittleEndian, []byte{'C', 'R', 2, 0, 0, 0, 0, 0})
+	_, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if format != "cr2" {
+		t.Errorf("got format %q, want cr2", format)
+	}
+	if _, ok := err.(cr2.FormatError); !ok {
+		t.Errorf("got error %v, want a cr2.FormatError", err)
+	}
+}
+
+// tiledDNG returns a little-endian DNG of 16x16 samples of 16 bits, in a
+// single uncompressed tile of the given dimensions
+func tiledDNG(tw uint32, th uint32) []byte {
+	type entry struct {
+		id, kind uint16
+		value    uint32
+	}
+	entries := []entry{
+		{0x00FE, 4, 0},
+		{0x0100, 4, 16},
+		{0x0101, 4, 16},
+		{0x0102, 3, 16},
+		{0x0103, 3, COMPRESSION_NONE},
+		{0x0106, 3, PHOTOMETRIC_CFA},
+		{0x0142, 4, tw},
+		{0x0143, 4, th},
+		{0x0144, 4, 8},
+		{0x0145, 4, 16 * 16 * 2},
+		{0xC612, 1, 0x00000401},
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("II")
+	binary.Write(buf, binary.LittleEndian, uint16(42))
+	binary.Write(buf, binary.LittleEndian, uint32(8+16*16*2))
+	buf.Write(make([]byte, 16*16*2))
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		count := uint32(1)
+		if e.kind == 1 {
+			count = 4
+		}
+		binary.Write(buf, binary.LittleEndian, []uint16{e.id, e.kind})
+		binary.Write(buf, binary.LittleEndian, count)
+		if e.kind == 3 {
+			binary.Write(buf, binary.LittleEndian, []uint16{uint16(e.value), 0})
+		} else {
+			binary.Write(buf, binary.LittleEndian, e.value)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	return buf.Bytes()
+}
+
+func TestDecodeRawHugeTiles(t *testing.T) {
+	_, err := DecodeRaw(bytes.NewReader(tiledDNG(16, 16)))
+	if _, ok := err.(UnsupportedError); !ok {
+		t.Fatalf("got error %v, want an UnsupportedError about the CFA pattern", err)
+	}
+	for _, size := range [][2]uint32{{0x80000000, 0x80000000}, {0x80000000, 16}, {16, 0xFFFFFFFF}, {4096, 4096}} {
+		_, err := DecodeRaw(bytes.NewReader(tiledDNG(size[0], size[1])))
+		if _, ok := err.(FormatError); !ok {
+			t.Errorf("%dx%d tiles: got error %v, want a FormatError", size[0], size[1], err)
+		}
+	}
+}
+
+// exifDNG returns a little-endian DNG whose EXIF IFD holds an exposure
+// time of 1/den seconds, without sensor data
+func exifDNG(den uint32) []byte {
+	le := binary.LittleEndian
+	buf := &bytes.Buffer{}
+	buf.WriteString("II")
+	binary.Write(buf, le, uint16(42))
+	binary.Write(buf, le, uint32(8))
+
+	// IFD0 at 8, holding DNGVersion and the offset of the EXIF IFD
+	binary.Write(buf, le, uint16(2))
+	binary.Write(buf, le, []uint16{0x8769, 4})
+	binary.Write(buf, le, []uint32{1, 38})
+	binary.Write(buf, le, []uint16{0xC612, 1})
+	binary.Write(buf, le, []uint32{4, 0x00000401})
+	binary.Write(buf, le, uint32(0))
+
+	// EXIF IFD at 38, the rational following it at 56
+	binary.Write(buf, le, uint16(1))
+	binary.Write(buf, le, []uint16{0x829A, 5})
+	binary.Write(buf, le, []uint32{1, 56})
+	binary.Write(buf, le, uint32(0))
+	binary.Write(buf, le, []uint32{1, den})
+	return buf.Bytes()
+}
+
+func TestExposureTime(t *testing.T) {
+	data := exifDNG(125)
+	v, err := ExposureTime(bytes.NewReader(data), int64(len(data)))
+	if err != nil || v != 1.0/125 {
+		t.Errorf("got %v and error %v, want %v", v, err, 1.0/125)
+	}
+	data = plainTIFF(binary.LittleEndian, nil)
+	_, err = ExposureTime(bytes.NewReader(data), int64(len(data)))
+	if err != errNotDNG {
+		t.Errorf("plain tiff: got error %v, want %v", err, errNotDNG)
+	}
+}
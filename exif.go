@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/aimxhaisse/kodama/gps"
+	"math"
+	"time"
+)
+
+// kinds of the tiff tags written in EXIF segments
+const (
+	EXIF_BYTE     = 1
+	EXIF_ASCII    = 2
+	EXIF_LONG     = 4
+	EXIF_RATIONAL = 5
+)
+
+// exifEntry is a tag of an IFD, with its encoded values
+type exifEntry struct {
+	Id    uint16
+	Kind  uint16
+	Count uint32
+	Data  []byte
+}
+
+// exifRationals encodes positive values as rationals with the given
+// denominator
+func exifRationals(id uint16, denominator uint32, values ...float64) exifEntry {
+	res := exifEntry{Id: id, Kind: EXIF_RATIONAL, Count: uint32(len(values))}
+	res.Data = make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(res.Data[8*i:], uint32(math.Round(v*float64(denominator))))
+		binary.LittleEndian.PutUint32(res.Data[8*i+4:], denominator)
+	}
+	return res
+}
+
+// exifASCII encodes a NUL-terminated string
+func exifASCII(id uint16, s string) exifEntry {
+	return exifEntry{Id: id, Kind: EXIF_ASCII, Count: uint32(len(s) + 1), Data: append([]byte(s), 0)}
+}
+
+// writeIFD appends an IFD to a tiff file, the values that don't fit in
+// its entries following it; entries must be sorted by id
+func writeIFD(buf *bytes.Buffer, entries []exifEntry) {
+	offset := uint32(buf.Len())
+	extra := offset + 2 + 12*uint32(len(entries)) + 4
+	values := []byte{}
+	binary.Write(buf, binary.LittleEndian, uint16(len(entries)))
+	for _, e := range entries {
+		binary.Write(buf, binary.LittleEndian, e.Id)
+		binary.Write(buf, binary.LittleEndian, e.Kind)
+		binary.Write(buf, binary.LittleEndian, e.Count)
+		if len(e.Data) <= 4 {
+			buf.Write(e.Data)
+			buf.Write(make([]byte, 4-len(e.Data)))
+			continue
+		}
+		binary.Write(buf, binary.LittleEndian, extra+uint32(len(values)))
+		values = append(values, e.Data...)
+		// values start on word boundaries
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(0))
+	buf.Write(values)
+}
+
+// gpsExif returns an EXIF APP1 segment of a JPEG file, holding the GPS IFD
+// of a position
+func gpsExif(g *gps.Position) []byte {
+	lat, lon := gps.DMS(g.Latitude), gps.DMS(g.Longitude)
+	lat_ref, lon_ref, alt_ref := "N", "E", uint8(0)
+	if g.Latitude < 0 {
+		lat_ref = "S"
+	}
+	if g.Longitude < 0 {
+		lon_ref = "W"
+	}
+	if g.Altitude < 0 {
+		alt_ref = 1
+	}
+	entries := []exifEntry{
+		{Id: 0x0000, Kind: EXIF_BYTE, Count: 4, Data: []byte{2, 3, 0, 0}},
+		exifASCII(0x0001, lat_ref),
+		exifRationals(0x0002, 100, lat[:]...),
+		exifASCII(0x0003, lon_ref),
+		exifRationals(0x0004, 100, lon[:]...),
+		{Id: 0x0005, Kind: EXIF_BYTE, Count: 1, Data: []byte{alt_ref}},
+		exifRationals(0x0006, 100, math.Abs(g.Altitude)),
+	}
+	if !g.Time.IsZero() {
+		t := g.Time.UTC()
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		seconds := t.Sub(day).Seconds()
+		entries = append(entries,
+			exifRationals(0x0007, 1, math.Floor(seconds/3600), math.Floor(math.Mod(seconds, 3600)/60), math.Floor(math.Mod(seconds, 60))),
+			exifASCII(0x001D, t.Format("2006:01:02")))
+	}
+
+	// IFD0 only points to the GPS IFD, which follows it
+	tiff := &bytes.Buffer{}
+	tiff.WriteString("II")
+	binary.Write(tiff, binary.LittleEndian, uint16(42))
+	binary.Write(tiff, binary.LittleEndian, uint32(8))
+	gps_offset := make([]byte, 4)
+	binary.LittleEndian.PutUint32(gps_offset, 8+2+12+4)
+	writeIFD(tiff, []exifEntry{{Id: 0x8825, Kind: EXIF_LONG, Count: 1, Data: gps_offset}})
+	writeIFD(tiff, entries)
+
+	res := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(res[2:], uint16(2+6+tiff.Len()))
+	res = append(res, "Exif\x00\x00"...)
+	return append(res, tiff.Bytes()...)
+}
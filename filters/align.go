@@ -0,0 +1,341 @@
+package filters
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"math/cmplx"
+)
+
+// available registrations of frames
+const (
+	ALIGN_NONE        = "none"
+	ALIGN_TRANSLATION = "translation"
+	ALIGN_ROTATION    = "rotation" // rotation then translation
+)
+
+// alignChoices are the values of the align parameter of filters
+var alignChoices = []string{ALIGN_NONE, ALIGN_TRANSLATION, ALIGN_ROTATION}
+
+// size of the planes frames are registered on, longer sides are reduced
+const alignSize = 512
+
+// number of refinements of the translation at full resolution
+const alignPasses = 2
+
+// Alignment moves a frame onto the image: a rotation around the center of
+// the frame, followed by a translation
+type Alignment struct {
+	Dx    float64 // in pixels
+	Dy    float64
+	Angle float64 // in degrees, clockwise
+}
+
+// String describes the alignment
+func (a Alignment) String() string {
+	return fmt.Sprintf("dx=%.2f dy=%.2f angle=%.2f", a.Dx, a.Dy, a.Angle)
+}
+
+// fft computes in place the discrete Fourier transform of values, whose
+// length is a power of two, or its inverse (without normalization)
+func fft(values []complex128, inverse bool) {
+	n := len(values)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+	sign := -1.0
+	if inverse {
+		sign = 1
+	}
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Rect(1, sign*2*math.Pi/float64(size))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := values[start+k], values[start+k+size/2]*w
+				values[start+k], values[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// fft2 computes in place the Fourier transform of a plane of n x n values
+func fft2(plane []complex128, n int, inverse bool) {
+	for y := 0; y < n; y++ {
+		fft(plane[y*n:(y+1)*n], inverse)
+	}
+	column := make([]complex128, n)
+	for x := 0; x < n; x++ {
+		for y := 0; y < n; y++ {
+			column[y] = plane[y*n+x]
+		}
+		fft(column, inverse)
+		for y := 0; y < n; y++ {
+			plane[y*n+x] = column[y]
+		}
+	}
+}
+
+// spectrum returns the Fourier transform of a plane of n x n values
+func spectrum(plane []float64, n int) []complex128 {
+	res := make([]complex128, n*n)
+	for i, v := range plane {
+		res[i] = complex(v, 0)
+	}
+	fft2(res, n, false)
+	return res
+}
+
+// phaseCorrelate returns the translation moving the plane b onto a, both
+// n x n values, with a subpixel precision
+func phaseCorrelate(a []float64, b []float64, n int) (float64, float64) {
+	fa, fb := spectrum(a, n), spectrum(b, n)
+	for i := range fa {
+		c := fa[i] * cmplx.Conj(fb[i])
+		if m := cmplx.Abs(c); m > 1e-12 {
+			fa[i] = c / complex(m, 0)
+		} else {
+			fa[i] = 0
+		}
+	}
+	fft2(fa, n, true)
+
+	best := 0
+	for i := range fa {
+		if real(fa[i]) > real(fa[best]) {
+			best = i
+		}
+	}
+	px, py := best%n, best/n
+	at := func(x, y int) float64 {
+		return real(fa[((y+n)%n)*n+(x+n)%n])
+	}
+
+	// the peak is refined by fitting a parabola through its neighbors
+	refine := func(l, c, r float64) float64 {
+		d := l - 2*c + r
+		if d >= 0 {
+			return 0
+		}
+		return math.Max(-0.5, math.Min(0.5, 0.5*(l-r)/d))
+	}
+	dx := float64(px) + refine(at(px-1, py), at(px, py), at(px+1, py))
+	dy := float64(py) + refine(at(px, py-1), at(px, py), at(px, py+1))
+	if dx > float64(n)/2 {
+		dx -= float64(n)
+	}
+	if dy > float64(n)/2 {
+		dy -= float64(n)
+	}
+	return dx, dy
+}
+
+// logPolar resamples the magnitude of the spectrum of a plane of n x n
+// values to n angles in [0, 180[ (rows) by n logarithmic radii (columns),
+// a rotation of the plane being a translation along the angles
+func logPolar(plane []float64, n int) []float64 {
+	f := spectrum(plane, n)
+	magnitude := func(u, v int) float64 {
+		// frequencies are wrapped, the spectrum being periodic
+		return math.Log1p(cmplx.Abs(f[((v+n)%n)*n+(u+n)%n]))
+	}
+	res := make([]float64, n*n)
+	max_radius := float64(n) / 2
+	for a := 0; a < n; a++ {
+		theta := math.Pi * float64(a) / float64(n)
+		for r := 0; r < n; r++ {
+			radius := math.Exp(math.Log(max_radius) * float64(r) / float64(n))
+			u, v := radius*math.Cos(theta), radius*math.Sin(theta)
+			u0, v0 := math.Floor(u), math.Floor(v)
+			fu, fv := u-u0, v-v0
+			iu, iv := int(u0), int(v0)
+			res[a*n+r] = (1-fu)*(1-fv)*magnitude(iu, iv) + fu*(1-fv)*magnitude(iu+1, iv) +
+				(1-fu)*fv*magnitude(iu, iv+1) + fu*fv*magnitude(iu+1, iv+1)
+		}
+	}
+	return res
+}
+
+// alignPlane is a reduced luminance plane of an image
+type alignPlane struct {
+	Values []float64 // n x n values, the image being at the top left
+	N      int       // power of two
+	Factor int       // pixels of the image per value
+	Width  int       // size of the image in the plane
+	Height int
+}
+
+// newAlignPlane reduces an area of an image to a luminance plane, by an
+// integer factor
+func newAlignPlane(img *image.RGBA64, bounds image.Rectangle, factor int) *alignPlane {
+	res := &alignPlane{N: 1, Factor: factor}
+	res.Width, res.Height = bounds.Dx()/factor, bounds.Dy()/factor
+	for res.N < MaxInt(res.Width, res.Height) {
+		res.N <<= 1
+	}
+	res.Values = make([]float64, res.N*res.N)
+	for y := 0; y < res.Height; y++ {
+		for x := 0; x < res.Width; x++ {
+			sum := 0.0
+			for sy := 0; sy < factor; sy++ {
+				i := img.PixOffset(bounds.Min.X+x*factor, bounds.Min.Y+y*factor+sy)
+				for sx := 0; sx < factor; sx, i = sx+1, i+8 {
+					pix := img.Pix[i : i+6 : i+6]
+					sum += float64(int(pix[0])<<8|int(pix[1])) + float64(int(pix[2])<<8|int(pix[3])) + float64(int(pix[4])<<8|int(pix[5]))
+				}
+			}
+			res.Values[y*res.N+x] = sum / float64(3*factor*factor*0xFFFF)
+		}
+	}
+	return res
+}
+
+// windowed returns values of the plane centered on their mean, and faded
+// to zero at the borders of the image by a Hann window, so that they don't
+// weigh in the correlation
+func (p *alignPlane) windowed(values []float64) []float64 {
+	mean := 0.0
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			mean += values[y*p.N+x]
+		}
+	}
+	mean /= float64(p.Width * p.Height)
+	res := make([]float64, p.N*p.N)
+	for y := 0; y < p.Height; y++ {
+		wy := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(y)+0.5)/float64(p.Height))
+		for x := 0; x < p.Width; x++ {
+			wx := 0.5 - 0.5*math.Cos(2*math.Pi*(float64(x)+0.5)/float64(p.Width))
+			res[y*p.N+x] = (values[y*p.N+x] - mean) * wx * wy
+		}
+	}
+	return res
+}
+
+// rotated returns the plane rotated clockwise by angle degrees around the
+// center of the image, areas out of the image being set to the mean
+func (p *alignPlane) rotated(angle float64) []float64 {
+	mean := 0.0
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			mean += p.Values[y*p.N+x]
+		}
+	}
+	mean /= float64(p.Width * p.Height)
+	res := make([]float64, p.N*p.N)
+	cx, cy := float64(p.Width-1)/2, float64(p.Height-1)/2
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			// source of the pixel, by the inverse rotation
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx, sy := cos*dx+sin*dy+cx, -sin*dx+cos*dy+cy
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			if x0 < 0 || y0 < 0 || x0+1 >= p.Width || y0+1 >= p.Height {
+				res[y*p.N+x] = mean
+				continue
+			}
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			v := p.Values[y0*p.N+x0:]
+			w := p.Values[(y0+1)*p.N+x0:]
+			res[y*p.N+x] = (1-fx)*(1-fy)*v[0] + fx*(1-fy)*v[1] + (1-fx)*fy*w[0] + fx*fy*w[1]
+		}
+	}
+	return res
+}
+
+// align estimates how frame must be moved onto img, with phase correlation
+// of their luminance (and of the log-polar resampling of their spectrum
+// for rotations, which turns them into translations). Images are reduced
+// to estimate the alignment, which is then refined at full resolution on
+// their center.
+func align(img *image.RGBA64, frame *image.RGBA64, mode string) Alignment {
+	res := Alignment{}
+	if mode == ALIGN_NONE {
+		return res
+	}
+	bounds := img.Bounds()
+	factor := (MaxInt(bounds.Dx(), bounds.Dy()) + alignSize - 1) / alignSize
+	ref, moving := newAlignPlane(img, bounds, factor), newAlignPlane(frame, bounds, factor)
+	n := ref.N
+	reference := ref.windowed(ref.Values)
+	values := moving.Values
+	if mode == ALIGN_ROTATION {
+		_, da := phaseCorrelate(logPolar(reference, n), logPolar(moving.windowed(values), n), n)
+		res.Angle = da * 180 / float64(n)
+		values = moving.rotated(res.Angle)
+	}
+	dx, dy := phaseCorrelate(reference, moving.windowed(values), n)
+	res.Dx, res.Dy = dx*float64(factor), dy*float64(factor)
+
+	// the residual translation of the aligned frame is measured on the
+	// center of the images
+	center := image.Rect(0, 0, alignSize, alignSize).Intersect(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	center = center.Add(bounds.Min.Add(bounds.Size().Sub(center.Size()).Div(2)))
+	ref = newAlignPlane(img, center, 1)
+	reference = ref.windowed(ref.Values)
+	for i := 0; i < alignPasses; i++ {
+		moving = newAlignPlane(warpArea(frame, res, nil, center), center, 1)
+		dx, dy = phaseCorrelate(reference, moving.windowed(moving.Values), ref.N)
+		res.Dx, res.Dy = res.Dx+dx, res.Dy+dy
+	}
+	return res
+}
+
+// warp moves a frame onto an image of the same size, with a bilinear
+// interpolation; pixels not covered by the frame are taken from fill, or
+// left transparent if it is nil
+func warp(frame *image.RGBA64, a Alignment, fill *image.RGBA64) *image.RGBA64 {
+	return warpArea(frame, a, fill, frame.Bounds())
+}
+
+// warpArea moves a frame onto an area of an image of the same size
+func warpArea(frame *image.RGBA64, a Alignment, fill *image.RGBA64, area image.Rectangle) *image.RGBA64 {
+	bounds := frame.Bounds()
+	out := image.NewRGBA64(area)
+	if fill != nil {
+		draw.Draw(out, area, fill, area.Min, draw.Src)
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	cx, cy := float64(w-1)/2, float64(h-1)/2
+	sin, cos := math.Sincos(a.Angle * math.Pi / 180)
+	for y := area.Min.Y - bounds.Min.Y; y < area.Max.Y-bounds.Min.Y; y++ {
+		for x := area.Min.X - bounds.Min.X; x < area.Max.X-bounds.Min.X; x++ {
+			// source of the pixel, by the inverse translation then rotation
+			dx, dy := float64(x)-a.Dx-cx, float64(y)-a.Dy-cy
+			sx, sy := cos*dx+sin*dy+cx, -sin*dx+cos*dy+cy
+			x0, y0 := int(math.Floor(sx)), int(math.Floor(sy))
+			if x0 < 0 || y0 < 0 || x0+1 >= w || y0+1 >= h {
+				continue
+			}
+			fx, fy := sx-float64(x0), sy-float64(y0)
+			weights := [4]float64{(1 - fx) * (1 - fy), fx * (1 - fy), (1 - fx) * fy, fx * fy}
+			offsets := [4]int{
+				frame.PixOffset(bounds.Min.X+x0, bounds.Min.Y+y0),
+				frame.PixOffset(bounds.Min.X+x0+1, bounds.Min.Y+y0),
+				frame.PixOffset(bounds.Min.X+x0, bounds.Min.Y+y0+1),
+				frame.PixOffset(bounds.Min.X+x0+1, bounds.Min.Y+y0+1),
+			}
+			i := out.PixOffset(bounds.Min.X+x, bounds.Min.Y+y)
+			for c := 0; c < 8; c += 2 {
+				acc := 0.0
+				for k, o := range offsets {
+					acc += weights[k] * float64(int(frame.Pix[o+c])<<8|int(frame.Pix[o+c+1]))
+				}
+				v := ClipInt(int(acc+0.5), 0, 0xFFFF)
+				out.Pix[i+c] = uint8(v >> 8)
+				out.Pix[i+c+1] = uint8(v)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,55 @@
+package filters
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// blobs returns an image of random soft spots of light on a dark
+// background
+func blobs(width int, height int) *image.RGBA64 {
+	rng := rand.New(rand.NewSource(1))
+	values := make([]float64, width*height)
+	for i := 0; i < 120; i++ {
+		cx, cy := rng.Float64()*float64(width), rng.Float64()*float64(height)
+		radius, level := 2+rng.Float64()*10, 0.2+rng.Float64()*0.8
+		for y := ClipInt(int(cy-3*radius), 0, height); y < ClipInt(int(cy+3*radius)+1, 0, height); y++ {
+			for x := ClipInt(int(cx-3*radius), 0, width); x < ClipInt(int(cx+3*radius)+1, 0, width); x++ {
+				d := (float64(x)-cx)*(float64(x)-cx) + (float64(y)-cy)*(float64(y)-cy)
+				values[y*width+x] += level * math.Exp(-d/(2*radius*radius))
+			}
+		}
+	}
+	res := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint16(ClipInt(int(values[y*width+x]*0xC000), 0, 0xFFFF))
+			res.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xFFFF})
+		}
+	}
+	return res
+}
+
+func TestAlign(t *testing.T) {
+	frame := blobs(400, 300)
+	tests := []struct {
+		mode  string
+		moved Alignment // of the frame onto the image
+		want  Alignment
+	}{
+		{ALIGN_NONE, Alignment{12, -7, 0}, Alignment{}},
+		{ALIGN_TRANSLATION, Alignment{}, Alignment{}},
+		{ALIGN_TRANSLATION, Alignment{12, -7, 0}, Alignment{12, -7, 0}},
+		{ALIGN_ROTATION, Alignment{12, -7, 3}, Alignment{12, -7, 3}},
+		{ALIGN_ROTATION, Alignment{-5, 9, -2}, Alignment{-5, 9, -2}},
+	}
+	for _, test := range tests {
+		got := align(warp(frame, test.moved, nil), frame, test.mode)
+		if math.Abs(got.Dx-test.want.Dx) > 0.2 || math.Abs(got.Dy-test.want.Dy) > 0.2 || math.Abs(got.Angle-test.want.Angle) > 0.03 {
+			t.Errorf("align %s of a frame moved by %v: got %v, want %v", test.mode, test.moved, got, test.want)
+		}
+	}
+}
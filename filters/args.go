@@ -0,0 +1,96 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Length is a parameter given in pixels or relative to an image dimension
+type Length struct {
+	Value   float64 // number of pixels, or percentage of the dimension
+	Percent bool    // true if the value is a percentage
+}
+
+// Pixels returns the length in pixels for a dimension of size pixels
+func (l Length) Pixels(size int) float64 {
+	if l.Percent {
+		return l.Value * float64(size) / 100
+	}
+	return l.Value
+}
+
+// String returns the length as it would be written in a script
+func (l Length) String() string {
+	s := strconv.FormatFloat(l.Value, 'g', -1, 64)
+	if l.Percent {
+		s += "%"
+	}
+	return s
+}
+
+// paramError returns an error about the parameter of a filter
+func paramError(filter string, name string, format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("invalid parameter '%s' for %s: %s", name, filter, fmt.Sprintf(format, args...)))
+}
+
+// ParseInt parses a signed integer parameter
+func ParseInt(filter string, name string, arg string) (int, error) {
+	v, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, paramError(filter, name, "expected an integer, got '%s'", arg)
+	}
+	return v, nil
+}
+
+// ParseFloat parses a signed real parameter
+func ParseFloat(filter string, name string, arg string) (float64, error) {
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, paramError(filter, name, "expected a number, got '%s'", arg)
+	}
+	return v, nil
+}
+
+// ParseExposure parses a strictly positive exposure time in seconds, as
+// a number or a fraction such as 1/250
+func ParseExposure(filter string, name string, arg string) (float64, error) {
+	parts := strings.SplitN(arg, "/", 2)
+	v, err := strconv.ParseFloat(parts[0], 64)
+	if err == nil && len(parts) == 2 {
+		var d float64
+		d, err = strconv.ParseFloat(parts[1], 64)
+		v /= d
+	}
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) || v <= 0 {
+		return 0, paramError(filter, name, "expected an exposure time in seconds, got '%s'", arg)
+	}
+	return v, nil
+}
+
+// ParsePercent parses a signed percentage, the % suffix is optional
+func ParsePercent(filter string, name string, arg string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, paramError(filter, name, "expected a percentage, got '%s'", arg)
+	}
+	return v, nil
+}
+
+// ParseLength parses a length in pixels, or relative to the image if
+// suffixed by %
+func ParseLength(filter string, name string, arg string) (Length, error) {
+	res := Length{}
+	if strings.HasSuffix(arg, "%") {
+		res.Percent = true
+		arg = strings.TrimSuffix(arg, "%")
+	}
+	v, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return res, paramError(filter, name, "expected a length in pixels or a percentage, got '%s'", arg)
+	}
+	res.Value = v
+	return res, nil
+}
@@ -1,33 +1,45 @@
 package filters
 
 import (
-	"errors"
-	"fmt"
 	"image"
 	"image/color"
-	"strconv"
+	"math"
 )
 
 // Blur is a filter that adds a blur to the image
 type Blur struct {
-	Radius int
+	Radius Length // relative to the longest side of the image
+}
+
+// blurSchema describes the parameters of blur
+var blurSchema = &Schema{
+	Name: "blur",
+	Doc:  "adds a box blur to the image",
+	Params: []*Param{
+		{Name: "radius", Kind: PARAM_LENGTH, Range: Positive, Doc: "radius of the box, in pixels or % of the longest side"},
+	},
+}
+
+func init() {
+	Register(blurSchema, func(argv []string) (Filter, error) {
+		return NewBlur(argv)
+	})
 }
 
 // NewBlur creates a new filter for blur
 func NewBlur(argv []string) (*Blur, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for blur, expected usage: blur <radius>")
-	}
-	radius, err := strconv.Atoi(argv[1])
+	args, err := blurSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for blur: %s", err.Error()))
+		return nil, err
 	}
-	if radius > 0 {
-		return &Blur{
-			radius,
-		}, nil
-	}
-	return nil, errors.New("parameter 'radius' must be > 0")
+	return &Blur{
+		args.Length("radius"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter Blur) Schema() *Schema {
+	return blurSchema
 }
 
 // Process applies a blur filter to the image
@@ -35,6 +47,22 @@ func (filter Blur) Process(img *FilterImage) error {
 	in := img.Image
 	bounds := in.Bounds()
 	out := image.NewRGBA64(bounds)
+
+	// Pixels at a fractional distance of the center are partially
+	// accounted for, so that radius varies smoothly.
+	radius := img.Scaled(filter.Radius, MaxInt(bounds.Dx(), bounds.Dy()))
+	reach := int(math.Ceil(radius))
+	edge := radius - math.Floor(radius)
+	if edge == 0 {
+		edge = 1
+	}
+	weight := func(d int) float64 {
+		if d == reach || d == -reach {
+			return edge
+		}
+		return 1
+	}
+
 	// This is a naive implementation with a high complexity.
 	// Each output pixel is the average of all pixels in its
 	// surrounding box, thus complexity is W*H*R^2
@@ -42,35 +70,23 @@ func (filter Blur) Process(img *FilterImage) error {
 		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 			_, _, _, a := in.At(x, y).RGBA()
 
-			x_start := 0
-			y_start := 0
-			x_end := bounds.Max.X
-			y_end := bounds.Max.Y
-
-			if x-filter.Radius > 0 {
-				x_start = x - filter.Radius
-			}
-			if x+filter.Radius < bounds.Max.X {
-				x_end = x + filter.Radius
-			}
-			if y-filter.Radius > 0 {
-				y_start = y - filter.Radius
-			}
-			if y+filter.Radius < bounds.Max.Y {
-				y_end = y + filter.Radius
-			}
+			x_start := ClipInt(x-reach, bounds.Min.X, bounds.Max.X-1)
+			x_end := ClipInt(x+reach, bounds.Min.X, bounds.Max.X-1)
+			y_start := ClipInt(y-reach, bounds.Min.Y, bounds.Max.Y-1)
+			y_end := ClipInt(y+reach, bounds.Min.Y, bounds.Max.Y-1)
 
-			avg_r := uint32(0)
-			avg_g := uint32(0)
-			avg_b := uint32(0)
-			pixels := uint32(0)
+			avg_r := 0.0
+			avg_g := 0.0
+			avg_b := 0.0
+			pixels := 0.0
 			for in_x := x_start; in_x <= x_end; in_x++ {
 				for in_y := y_start; in_y <= y_end; in_y++ {
 					in_r, in_g, in_b, _ := in.At(in_x, in_y).RGBA()
-					avg_r += in_r
-					avg_g += in_g
-					avg_b += in_b
-					pixels++
+					w := weight(in_x-x) * weight(in_y-y)
+					avg_r += w * float64(in_r)
+					avg_g += w * float64(in_g)
+					avg_b += w * float64(in_b)
+					pixels += w
 				}
 			}
 
@@ -1,54 +1,75 @@
 package filters
 
 import (
-	"errors"
-	"fmt"
 	"image/color"
-	"strconv"
 )
 
 // Brightness is a filter that modifies the brightness of the image
 type Brightness struct {
-	Strength uint32 // Percentage of brightness to apply
+	Strength float64 // Percentage of brightness to apply (negative darkens)
+}
+
+// brightnessSchema describes the parameters of brightness
+var brightnessSchema = &Schema{
+	Name: "brightness",
+	Doc:  "increases the brightness of the image",
+	Params: []*Param{
+		{Name: "strength", Kind: PARAM_PERCENT, Doc: "percentage of the full range to add, negative darkens"},
+	},
+}
+
+func init() {
+	Register(brightnessSchema, func(argv []string) (Filter, error) {
+		return NewBrightness(argv)
+	})
 }
 
 // NewBrightness creates a new filter for brightness
 func NewBrightness(argv []string) (*Brightness, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for brightness, expected usage: brightness <strength>")
-	}
-	strength, err := strconv.Atoi(argv[1])
+	args, err := brightnessSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for brightness: %s", err.Error()))
-	}
-	if strength > 0 {
-		return &Brightness{
-			uint32(strength),
-		}, nil
+		return nil, err
 	}
-	return nil, errors.New("parameter 'strength' must be > 0")
+	return &Brightness{
+		args.Float("strength"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *Brightness) Schema() *Schema {
+	return brightnessSchema
 }
 
 // This filter is scalable
 func (filter *Brightness) IsScalable() {
 }
 
+// This filter works on sRGB components
+func (filter *Brightness) IsPerceptual() {
+}
+
 // Process applies a brightness filter to the image
 func (filter *Brightness) Process(img *FilterImage) error {
+	shiftBrightness(img, filter.Strength)
+	return nil
+}
+
+// shiftBrightness adds a percentage of the full range to each component
+func shiftBrightness(img *FilterImage, strength float64) {
 	out := img.Image
 	bounds := out.Bounds()
+	delta := int32(0xFFFF * strength / 100)
 	for x := bounds.Min.X; x < bounds.Max.X; x++ {
 		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 			r, g, b, a := out.At(x, y).RGBA()
 
 			// r, g, b, a are 16bits components in a uint32
-			nr := Trunc(r + (0xFFFF*filter.Strength)/100)
-			ng := Trunc(g + (0xFFFF*filter.Strength)/100)
-			nb := Trunc(b + (0xFFFF*filter.Strength)/100)
+			nr := Strunc(int32(r) + delta)
+			ng := Strunc(int32(g) + delta)
+			nb := Strunc(int32(b) + delta)
 
 			nc := color.NRGBA64{nr, ng, nb, uint16(a)}
 			out.Set(x, y, nc)
 		}
 	}
-	return nil
 }
@@ -0,0 +1,109 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"os"
+)
+
+// DarkFrame is a filter that subtracts a dark frame (a shot taken with the
+// lens capped, with the same exposure and sensor temperature) to remove
+// the thermal noise and the amp glow of the sensor
+type DarkFrame struct {
+	Path  string
+	raw   *cr2.Raw     // sensor data of the dark frame, loaded on first use
+	image *FilterImage // dark frame for other inputs, loaded on first use
+}
+
+// darkFrameSchema describes the parameters of darkframe
+var darkFrameSchema = &Schema{
+	Name: "darkframe",
+	Doc:  "subtracts a dark frame, before development for raw inputs",
+	Params: []*Param{
+		{Name: "input", Kind: PARAM_STRING, Doc: "path of the dark frame, raw if the image is"},
+	},
+}
+
+func init() {
+	Register(darkFrameSchema, func(argv []string) (Filter, error) {
+		return NewDarkFrame(argv)
+	})
+}
+
+// NewDarkFrame creates a new filter for darkframe
+func NewDarkFrame(argv []string) (*DarkFrame, error) {
+	args, err := darkFrameSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	path := args.String("input")
+	_, err = os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
+	}
+	return &DarkFrame{Path: path}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *DarkFrame) Schema() *Schema {
+	return darkFrameSchema
+}
+
+// ProcessRaw subtracts the dark frame from the samples, keeping the black
+// level of the image
+func (filter *DarkFrame) ProcessRaw(raw *cr2.Raw) error {
+	if filter.raw == nil {
+		if !IsRaw(filter.Path) {
+			return errors.New(fmt.Sprintf("dark frame %s of a raw image must be raw", filter.Path))
+		}
+		var err error
+		filter.raw, err = loadRaw(filter.Path)
+		if err != nil {
+			return err
+		}
+	}
+	dark := filter.raw
+	if dark.Bounds() != raw.Bounds() {
+		return errors.New(fmt.Sprintf("dark frame is %v, image is %v", dark.Bounds().Size(), raw.Bounds().Size()))
+	}
+
+	// samples of the dark frame are offset by its own black level
+	offset := int(dark.Black + 0.5)
+	for i := 0; i+1 < len(raw.Pix); i += 2 {
+		v := int(raw.Pix[i])<<8 | int(raw.Pix[i+1])
+		d := int(dark.Pix[i])<<8 | int(dark.Pix[i+1])
+		n := Strunc(int32(v - d + offset))
+		raw.Pix[i] = uint8(n >> 8)
+		raw.Pix[i+1] = uint8(n)
+	}
+	return nil
+}
+
+// Process subtracts the components of the dark frame, in linear light
+func (filter *DarkFrame) Process(img *FilterImage) error {
+	if filter.image == nil {
+		var err error
+		filter.image, err = loadImage(filter.Path, img.Raw)
+		if err != nil {
+			return err
+		}
+	}
+	dark := filter.image
+	dark.SetLinear(img.Linear)
+	out := img.Image
+	bounds := out.Bounds()
+	if dark.Image.Bounds() != bounds {
+		return errors.New(fmt.Sprintf("dark frame is %v, image is %v", dark.Image.Bounds().Size(), bounds.Size()))
+	}
+	for i := 0; i+7 < len(out.Pix); i += 8 {
+		for c := 0; c < 6; c += 2 {
+			v := int32(out.Pix[i+c])<<8 | int32(out.Pix[i+c+1])
+			d := int32(dark.Image.Pix[i+c])<<8 | int32(dark.Image.Pix[i+c+1])
+			n := Strunc(v - d)
+			out.Pix[i+c] = uint8(n >> 8)
+			out.Pix[i+c+1] = uint8(n)
+		}
+	}
+	return nil
+}
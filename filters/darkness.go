@@ -1,50 +1,47 @@
 package filters
 
-import (
-	"errors"
-	"fmt"
-	"image/color"
-	"strconv"
-)
-
 // Darkness is a filter that modifies the darkness of the image
 type Darkness struct {
-	Strength uint32 // Percentage of darkness to apply
+	Strength float64 // Percentage of darkness to apply (negative brightens)
+}
+
+// darknessSchema describes the parameters of darkness
+var darknessSchema = &Schema{
+	Name: "darkness",
+	Doc:  "decreases the brightness of the image",
+	Params: []*Param{
+		{Name: "strength", Kind: PARAM_PERCENT, Doc: "percentage of the full range to remove, negative brightens"},
+	},
+}
+
+func init() {
+	Register(darknessSchema, func(argv []string) (Filter, error) {
+		return NewDarkness(argv)
+	})
 }
 
 // NewDarkness creates a new filter for darkness
 func NewDarkness(argv []string) (*Darkness, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for darkness, expected usage: darkness <strength>")
-	}
-	strength, err := strconv.Atoi(argv[1])
+	args, err := darknessSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for darkness: %s", err.Error()))
-	}
-	if strength > 0 {
-		return &Darkness{
-			uint32(strength),
-		}, nil
+		return nil, err
 	}
-	return nil, errors.New("parameter 'strength' must be > 0")
+	return &Darkness{
+		args.Float("strength"),
+	}, nil
 }
 
-// Process applies a darkness filter to the image
-func (filter *Darkness) Process(img *FilterImage) error {
-	out := img.Image
-	bounds := out.Bounds()
-	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			r, g, b, a := out.At(x, y).RGBA()
+// Schema describes the parameters of the filter
+func (filter *Darkness) Schema() *Schema {
+	return darknessSchema
+}
 
-			nr := Strunc(int32(r - (0xFFFF*filter.Strength)/100))
-			ng := Strunc(int32(g - (0xFFFF*filter.Strength)/100))
-			nb := Strunc(int32(b - (0xFFFF*filter.Strength)/100))
+// This filter works on sRGB components
+func (filter *Darkness) IsPerceptual() {
+}
 
-			nc := color.NRGBA64{nr, ng, nb, uint16(a)}
-			out.Set(x, y, nc)
-		}
-	}
-	img.Image = out
+// Process applies a darkness filter to the image
+func (filter *Darkness) Process(img *FilterImage) error {
+	shiftBrightness(img, -filter.Strength)
 	return nil
 }
@@ -0,0 +1,209 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"math"
+	"os"
+)
+
+// FlatField is a filter that divides the image by a flat frame (a shot of
+// an evenly lit surface, with the same optics) normalized to its mean, to
+// correct vignetting and shadows of dust on the sensor
+type FlatField struct {
+	Path   string
+	Smooth float64   // radius of the box blur applied to the flat, in pixels
+	raw    []float64 // gains of the sensor sites, computed on first use
+	image  []float64 // gains of the components, computed on first use
+}
+
+// flatFieldSchema describes the parameters of flatfield
+var flatFieldSchema = &Schema{
+	Name: "flatfield",
+	Doc:  "divides the image by a normalized flat frame, before development for raw inputs",
+	Params: []*Param{
+		{Name: "input", Kind: PARAM_STRING, Doc: "path of the flat frame, raw if the image is"},
+		{Name: "smooth", Kind: PARAM_FLOAT, Range: &Range{0, 1000, false}, Default: "0", Doc: "radius of the blur removing the noise of the flat, in pixels"},
+	},
+}
+
+func init() {
+	Register(flatFieldSchema, func(argv []string) (Filter, error) {
+		return NewFlatField(argv)
+	})
+}
+
+// NewFlatField creates a new filter for flatfield
+func NewFlatField(argv []string) (*FlatField, error) {
+	args, err := flatFieldSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	path := args.String("input")
+	_, err = os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
+	}
+	return &FlatField{Path: path, Smooth: args.Float("smooth")}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *FlatField) Schema() *Schema {
+	return flatFieldSchema
+}
+
+// smoothPlane applies a box blur of the given radius to a plane of w x h
+// values, only mixing values step apart (the sites of a color of a Bayer
+// pattern are two sites apart)
+func smoothPlane(plane []float64, w int, h int, radius int, step int) {
+	if radius <= 0 {
+		return
+	}
+	line := make([]float64, MaxInt(w, h))
+	sums := make([]float64, MaxInt(w, h)+1)
+
+	// the blur is separable, lines then columns
+	pass := func(n int, at func(i int) *float64) {
+		for p := 0; p < step && p < n; p++ {
+			m := 0
+			for i := p; i < n; i += step {
+				line[m] = *at(i)
+				sums[m+1] = sums[m] + line[m]
+				m++
+			}
+			for k := 0; k < m; k++ {
+				lo, hi := MaxInt(k-radius, 0), k+radius+1
+				if hi > m {
+					hi = m
+				}
+				*at(p + k*step) = (sums[hi] - sums[lo]) / float64(hi-lo)
+			}
+		}
+	}
+	for y := 0; y < h; y++ {
+		pass(w, func(i int) *float64 { return &plane[y*w+i] })
+	}
+	for x := 0; x < w; x++ {
+		pass(h, func(i int) *float64 { return &plane[i*w+x] })
+	}
+}
+
+// gains turns the planes of a flat frame into the gains correcting each
+// value, in place, the planes being interleaved in a pattern of step x
+// step values normalized to their own mean
+func gains(plane []float64, w int, h int, step int) {
+	sums := make([]float64, step*step)
+	counts := make([]float64, step*step)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sums[(y%step)*step+x%step] += plane[y*w+x]
+			counts[(y%step)*step+x%step]++
+		}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := (y%step)*step + x%step
+			v := plane[y*w+x]
+			// dead areas of the flat are left uncorrected
+			if v <= 0 || sums[i] <= 0 {
+				plane[y*w+x] = 1
+				continue
+			}
+			plane[y*w+x] = sums[i] / counts[i] / v
+		}
+	}
+}
+
+// ProcessRaw divides the samples above the black level of the active area
+// by the flat, each color being normalized on its own
+func (filter *FlatField) ProcessRaw(raw *cr2.Raw) error {
+	area := raw.Active
+	w, h := area.Dx(), area.Dy()
+	if filter.raw == nil {
+		if !IsRaw(filter.Path) {
+			return errors.New(fmt.Sprintf("flat frame %s of a raw image must be raw", filter.Path))
+		}
+		flat, err := loadRaw(filter.Path)
+		if err != nil {
+			return err
+		}
+		if flat.Bounds() != raw.Bounds() || flat.Active != area {
+			return errors.New(fmt.Sprintf("flat frame is %v, image is %v", flat.Active.Size(), area.Size()))
+		}
+		plane := make([]float64, w*h)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				plane[y*w+x] = float64(flat.Gray16At(area.Min.X+x, area.Min.Y+y).Y) - flat.Black
+			}
+		}
+		smoothPlane(plane, w, h, int(filter.Smooth/2+0.5), 2)
+		gains(plane, w, h, 2)
+		filter.raw = plane
+	}
+	if len(filter.raw) != w*h {
+		return errors.New(fmt.Sprintf("flat frame doesn't match the image (%v)", area.Size()))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := raw.PixOffset(area.Min.X+x, area.Min.Y+y)
+			v := float64(int(raw.Pix[i])<<8|int(raw.Pix[i+1])) - raw.Black
+			n := Strunc(int32(math.Min(v*filter.raw[y*w+x]+raw.Black+0.5, 0xFFFF)))
+			raw.Pix[i] = uint8(n >> 8)
+			raw.Pix[i+1] = uint8(n)
+		}
+	}
+	return nil
+}
+
+// Process divides the components of the image by the flat, in linear
+// light, each component being normalized on its own
+func (filter *FlatField) Process(img *FilterImage) error {
+	out := img.Image
+	bounds := out.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if filter.image == nil {
+		flat, err := loadImage(filter.Path, img.Raw)
+		if err != nil {
+			return err
+		}
+		if flat.Image.Bounds() != bounds {
+			return errors.New(fmt.Sprintf("flat frame is %v, image is %v", flat.Image.Bounds().Size(), bounds.Size()))
+		}
+		flat.SetLinear(true)
+
+		// components are stored side by side, as a pattern of 3 x 1 values
+		planes := make([]float64, 3*w*h)
+		for c := 0; c < 3; c++ {
+			plane := make([]float64, w*h)
+			for i := range plane {
+				j := 8*i + 2*c
+				plane[i] = float64(int(flat.Image.Pix[j])<<8 | int(flat.Image.Pix[j+1]))
+			}
+			smoothPlane(plane, w, h, int(filter.Smooth+0.5), 1)
+			gains(plane, w, h, 1)
+			for i := range plane {
+				planes[3*i+c] = plane[i]
+			}
+		}
+		filter.image = planes
+	}
+	if len(filter.image) != 3*w*h {
+		return errors.New(fmt.Sprintf("flat frame doesn't match the image (%v)", bounds.Size()))
+	}
+
+	linear := img.Linear
+	img.SetLinear(true)
+	for i := 0; i < w*h; i++ {
+		for c := 0; c < 3; c++ {
+			j := 8*i + 2*c
+			v := float64(int(out.Pix[j])<<8 | int(out.Pix[j+1]))
+			n := Strunc(int32(math.Min(v*filter.image[3*i+c]+0.5, 0xFFFF)))
+			out.Pix[j] = uint8(n >> 8)
+			out.Pix[j+1] = uint8(n)
+		}
+	}
+	img.SetLinear(linear)
+	return nil
+}
@@ -0,0 +1,60 @@
+package filters
+
+import (
+	"github.com/aimxhaisse/kodama/srgb"
+)
+
+// Perceptual is implemented by filters that expect sRGB encoded
+// components instead of linear light ones
+type Perceptual interface {
+	IsPerceptual()
+}
+
+// ToLinear converts a 16bits sRGB component to linear light
+func ToLinear(component uint32) uint32 {
+	return uint32(srgb.ToLinear(Trunc(component)))
+}
+
+// ToSRGB converts a 16bits linear light component to sRGB
+func ToSRGB(component uint32) uint32 {
+	return uint32(srgb.FromLinear(Trunc(component)))
+}
+
+// SetLinear converts the image to linear light (or back to sRGB)
+func (img *FilterImage) SetLinear(linear bool) {
+	if img.Linear == linear {
+		return
+	}
+	convert := srgb.FromLinear
+	if linear {
+		convert = srgb.ToLinear
+	}
+
+	// components are alpha-premultiplied, so the transfer function
+	// must be applied on the straight values
+	out := img.Image
+	bounds := out.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := out.PixOffset(bounds.Min.X, y)
+		for x := bounds.Min.X; x < bounds.Max.X; x, i = x+1, i+8 {
+			pix := out.Pix[i : i+8 : i+8]
+			a := uint32(pix[6])<<8 | uint32(pix[7])
+			if a == 0 {
+				continue
+			}
+			for c := 0; c < 6; c += 2 {
+				v := uint32(pix[c])<<8 | uint32(pix[c+1])
+				if a != 0xFFFF {
+					v = uint32(Trunc(v * 0xFFFF / a))
+				}
+				v = uint32(convert(uint16(v)))
+				if a != 0xFFFF {
+					v = v * a / 0xFFFF
+				}
+				pix[c] = uint8(v >> 8)
+				pix[c+1] = uint8(v)
+			}
+		}
+	}
+	img.Linear = linear
+}
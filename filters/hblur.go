@@ -1,44 +1,56 @@
 package filters
 
 import (
-	"errors"
-	"fmt"
 	"image"
 	"image/color"
-	"strconv"
 )
 
 // HBlur is a filter that adds a horizontal blur to the image
 type HBlur struct {
-	Strength int
+	Strength Length // relative to the width of the image
+}
+
+// hblurSchema describes the parameters of hblur
+var hblurSchema = &Schema{
+	Name: "hblur",
+	Doc:  "adds a horizontal blur to the image",
+	Params: []*Param{
+		{Name: "strength", Kind: PARAM_LENGTH, Range: Positive, Doc: "size of the blur, in pixels or % of the width"},
+	},
+}
+
+func init() {
+	Register(hblurSchema, func(argv []string) (Filter, error) {
+		return NewHBlur(argv)
+	})
 }
 
 // NewHBlur creates a new filter for blur
 func NewHBlur(argv []string) (*HBlur, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for hblur, expected usage: hblur <strength>")
-	}
-	strength, err := strconv.Atoi(argv[1])
+	args, err := hblurSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for hblur: %s", err.Error()))
-	}
-	if strength > 0 {
-		return &HBlur{
-			strength,
-		}, nil
+		return nil, err
 	}
-	return nil, errors.New("parameter 'strenght' must be > 0")
+	return &HBlur{
+		args.Length("strength"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *HBlur) Schema() *Schema {
+	return hblurSchema
 }
 
 // Process applies a horizontal blur filter to the image (efficient implementation)
 func (filter *HBlur) Process(img *FilterImage) error {
 	out := img.Image
 	bounds := out.Bounds()
+	strength := int(img.Scaled(filter.Strength, bounds.Dx()) + 0.5)
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		prev_blur := filter.computeInitialBlur(out, bounds, y)
+		prev_blur := filter.computeInitialBlur(out, bounds, strength, y)
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			prev_x := ClipInt(x-filter.Strength/2, 0, bounds.Max.X-1)
-			next_x := ClipInt(x+filter.Strength/2, 0, bounds.Max.X-1)
+			prev_x := ClipInt(x-strength/2, 0, bounds.Max.X-1)
+			next_x := ClipInt(x+strength/2, 0, bounds.Max.X-1)
 
 			nb_elems := next_x - prev_x + 1
 
@@ -60,9 +72,9 @@ func (filter *HBlur) Process(img *FilterImage) error {
 }
 
 // computeInitialBlur computes the blur of the bound pixel
-func (filter *HBlur) computeInitialBlur(in image.Image, bounds image.Rectangle, y int) color.Color {
-	start := ClipInt(bounds.Min.X-filter.Strength/2, 0, bounds.Max.X)
-	end := ClipInt(bounds.Min.X+filter.Strength/2, 0, bounds.Max.X)
+func (filter *HBlur) computeInitialBlur(in image.Image, bounds image.Rectangle, strength int, y int) color.Color {
+	start := ClipInt(bounds.Min.X-strength/2, 0, bounds.Max.X)
+	end := ClipInt(bounds.Min.X+strength/2, 0, bounds.Max.X)
 
 	var vbr, vbg, vbb, vba int
 	for iter := start; iter <= end; iter++ {
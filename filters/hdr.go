@@ -0,0 +1,262 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/dng"
+	"image"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// bounds of the sRGB values weighed when merging exposures, darker values
+// being noisy and brighter ones clipped
+const (
+	hdrLow  = 0.02
+	hdrHigh = 0.95
+)
+
+// RadianceFilter is implemented by filters that keep the radiance merged
+// by hdr up to date with the components of the image
+type RadianceFilter interface {
+	IsRadiance()
+}
+
+// HDR is a filter that merges the image with bracketed exposures of the
+// same scene into a radiance image, whose range isn't limited
+type HDR struct {
+	Frames    []string  // paths of the frames
+	Exposures []float64 // exposure times of the image then the frames in seconds, nil to read them from the files
+	Align     string    // registration of the frames, none, translation or rotation
+
+	// alignments estimated for the frames of the last image
+	Alignments []Alignment
+}
+
+// hdrSchema describes the parameters of hdr
+var hdrSchema = &Schema{
+	Name: "hdr",
+	Doc:  "merges the image with bracketed exposures into a radiance image, to be tone mapped",
+	Params: []*Param{
+		{Name: "frames", Kind: PARAM_STRING, Variadic: true, Doc: "paths or glob patterns of the frames"},
+		{Name: "exposures", Kind: PARAM_STRING, Default: "exif", Doc: "comma-separated exposure times of the image then the frames, exif to read them from raw files"},
+		{Name: "align", Kind: PARAM_CHOICE, Choices: alignChoices, Default: ALIGN_NONE, Doc: "how frames are registered on the image before they are merged"},
+	},
+}
+
+func init() {
+	Register(hdrSchema, func(argv []string) (Filter, error) {
+		return NewHDR(argv)
+	})
+}
+
+// NewHDR creates a new filter for hdr, expanding glob patterns
+func NewHDR(argv []string) (*HDR, error) {
+	args, err := hdrSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	res := &HDR{Align: args.String("align")}
+	for _, pattern := range args.Strings("frames") {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid pattern %s: %s", pattern, err.Error()))
+		}
+		if len(paths) == 0 {
+			return nil, errors.New(fmt.Sprintf("no frame matches %s", pattern))
+		}
+		res.Frames = append(res.Frames, paths...)
+	}
+	if exposures := args.String("exposures"); exposures != "exif" {
+		for _, arg := range strings.Split(exposures, ",") {
+			v, err := ParseExposure(hdrSchema.Name, "exposures", arg)
+			if err != nil {
+				return nil, err
+			}
+			res.Exposures = append(res.Exposures, v)
+		}
+		if len(res.Exposures) != len(res.Frames)+1 {
+			return nil, paramError(hdrSchema.Name, "exposures", "expected %d exposure times (the image then the frames), got %d", len(res.Frames)+1, len(res.Exposures))
+		}
+	}
+	return res, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *HDR) Schema() *Schema {
+	return hdrSchema
+}
+
+// IsRadiance marks the filter as writing the radiance of the image
+func (filter *HDR) IsRadiance() {
+}
+
+// Report describes the alignments of the frames
+func (filter *HDR) Report() []string {
+	if filter.Align == ALIGN_NONE {
+		return nil
+	}
+	res := []string{}
+	for i, a := range filter.Alignments {
+		res = append(res, fmt.Sprintf("%s aligned %s", filter.Frames[i], a))
+	}
+	return res
+}
+
+// ReadExposure returns the exposure time of a raw file, 0 if unknown
+func ReadExposure(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	res := 0.0
+	if strings.ToLower(filepath.Ext(path)) == ".dng" {
+		res, err = dng.ExposureTime(file, info.Size())
+	} else {
+		var f *cr2.File
+		f, err = cr2.Open(file, info.Size())
+		if err == nil {
+			res = f.Metadata().ExposureTime
+		}
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("can't read the exposure time of %s, give it with exposures=", path))
+	}
+	return res, nil
+}
+
+// exposures returns the exposure times of the image then the frames
+func (filter *HDR) exposures(img *FilterImage) ([]float64, error) {
+	if filter.Exposures != nil {
+		return filter.Exposures, nil
+	}
+	if img.Exposure <= 0 {
+		return nil, errors.New("unknown exposure time of the image, give them with exposures=")
+	}
+	res := []float64{img.Exposure}
+	for _, path := range filter.Frames {
+		v, err := ReadExposure(path)
+		if err != nil {
+			return nil, err
+		}
+		if v <= 0 {
+			return nil, errors.New(fmt.Sprintf("unknown exposure time of %s, give them with exposures=", path))
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// hatWeight weighs a value in [0, 1] encoded in sRGB by how well it
+// measures the radiance of the scene
+func hatWeight(z float64) float64 {
+	if z <= hdrLow || z >= hdrHigh {
+		return 0
+	}
+	return math.Min(z-hdrLow, hdrHigh-z)
+}
+
+// brightest returns the greatest component of the pixel at offset i
+func brightest(pix []uint8, i int) int {
+	r := int(pix[i])<<8 | int(pix[i+1])
+	g := int(pix[i+2])<<8 | int(pix[i+3])
+	b := int(pix[i+4])<<8 | int(pix[i+5])
+	return MaxInt(r, MaxInt(g, b))
+}
+
+// accumulate adds the radiance of a frame in linear light, scaled from
+// its exposure to the one of the image, weighted by the brightest
+// component of each pixel (weights of all the components are the same, so
+// that colors don't shift where a component clips). Where no frame is
+// weighed, the closest bound of the radiance is kept: the greatest value
+// of the clipped frames where the image is bright, the lowest value of
+// the dark frames otherwise; weights are then negative.
+func accumulate(sums []float32, weights []float32, img *image.RGBA64, frame *image.RGBA64, scale float64) {
+	for p := range weights {
+		i := 8 * p
+		// areas an aligned frame doesn't cover are transparent
+		if frame.Pix[i+6] == 0 && frame.Pix[i+7] == 0 {
+			continue
+		}
+		values := [3]float32{}
+		for c := 0; c < 3; c++ {
+			values[c] = float32(float64(int(frame.Pix[i+2*c])<<8|int(frame.Pix[i+2*c+1])) / 0xFFFF * scale)
+		}
+		sum := sums[3*p : 3*p+3 : 3*p+3]
+		w := float32(hatWeight(float64(ToSRGB(uint32(brightest(frame.Pix, i)))) / 0xFFFF))
+		switch {
+		case w > 0:
+			if weights[p] < 0 {
+				sum[0], sum[1], sum[2], weights[p] = 0, 0, 0, 0
+			}
+			for c := 0; c < 3; c++ {
+				sum[c] += w * values[c]
+			}
+			weights[p] += w
+		case weights[p] == 0:
+			copy(sum, values[:])
+			weights[p] = -1
+		case weights[p] < 0:
+			higher := values[0]+values[1]+values[2] > sum[0]+sum[1]+sum[2]
+			if higher == (brightest(img.Pix, i) >= 0x8000) {
+				copy(sum, values[:])
+			}
+		}
+	}
+}
+
+// Process merges the frames in linear light, one at a time. The image
+// then holds the radiance clipped to its range, until it is tone mapped.
+func (filter *HDR) Process(img *FilterImage) error {
+	exposures, err := filter.exposures(img)
+	if err != nil {
+		return err
+	}
+	linear := img.Linear
+	img.SetLinear(true)
+	defer img.SetLinear(linear)
+	filter.Alignments = nil
+
+	out := img.Image
+	n := len(out.Pix) / 8
+	sums := make([]float32, 3*n)
+	weights := make([]float32, n)
+	accumulate(sums, weights, out, out, 1)
+	for i, path := range filter.Frames {
+		frame, err := loadImage(path, img.Raw)
+		if err != nil {
+			return err
+		}
+		if frame.Image.Bounds() != out.Bounds() {
+			return errors.New(fmt.Sprintf("frame %s is %v, image is %v", path, frame.Image.Bounds().Size(), out.Bounds().Size()))
+		}
+		frame.SetLinear(true)
+		if filter.Align != ALIGN_NONE {
+			a := align(out, frame.Image, filter.Align)
+			filter.Alignments = append(filter.Alignments, a)
+			frame.Image = warp(frame.Image, a, nil)
+		}
+		accumulate(sums, weights, out, frame.Image, exposures[0]/exposures[i+1])
+	}
+
+	for p, w := range weights {
+		for c := 0; c < 3; c++ {
+			if w > 0 {
+				sums[3*p+c] /= w
+			}
+			v := Trunc(uint32(math.Min(float64(sums[3*p+c])*0xFFFF+0.5, 0xFFFF)))
+			out.Pix[8*p+2*c] = uint8(v >> 8)
+			out.Pix[8*p+2*c+1] = uint8(v)
+		}
+	}
+	img.Radiance = sums
+	return nil
+}
@@ -0,0 +1,130 @@
+package filters
+
+import (
+	"github.com/aimxhaisse/kodama/cr2"
+	"image"
+	"sort"
+)
+
+// HotPixels is a filter that replaces hot and stuck pixels (much brighter
+// or darker than all their neighbors) by the median of their neighbors
+type HotPixels struct {
+	Threshold float64 // percentage of the range a pixel must stand out by
+}
+
+// hotPixelsSchema describes the parameters of hotpixels
+var hotPixelsSchema = &Schema{
+	Name: "hotpixels",
+	Doc:  "removes hot and stuck pixels, before development for raw inputs",
+	Params: []*Param{
+		{Name: "threshold", Kind: PARAM_PERCENT, Range: &Range{0, 100, true}, Default: "10", Doc: "percentage of the full range a pixel must exceed (or fall below) all its neighbors by"},
+	},
+}
+
+func init() {
+	Register(hotPixelsSchema, func(argv []string) (Filter, error) {
+		return NewHotPixels(argv)
+	})
+}
+
+// NewHotPixels creates a new filter for hotpixels
+func NewHotPixels(argv []string) (*HotPixels, error) {
+	args, err := hotPixelsSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	return &HotPixels{
+		args.Float("threshold"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *HotPixels) Schema() *Schema {
+	return hotPixelsSchema
+}
+
+// outlier returns the value a pixel must be replaced with, and whether it
+// stands out of its neighbors by more than threshold
+func outlier(v int, neighbors []int, threshold int) (int, bool) {
+	if len(neighbors) < 3 {
+		return v, false
+	}
+	sort.Ints(neighbors)
+	if v <= neighbors[len(neighbors)-1]+threshold && v >= neighbors[0]-threshold {
+		return v, false
+	}
+	return neighbors[len(neighbors)/2], true
+}
+
+// ProcessRaw fixes the samples of the sensor, the neighbors of a site
+// being the nearest ones of the same color (two sites away in a Bayer
+// pattern)
+func (filter *HotPixels) ProcessRaw(raw *cr2.Raw) error {
+	white := raw.White
+	if white <= raw.Black {
+		white = float64(int(1)<<uint(raw.Bits) - 1)
+	}
+	threshold := int((white - raw.Black) * filter.Threshold / 100)
+
+	// fixes are applied once all pixels are checked
+	type sample struct {
+		X, Y, V int
+	}
+	fixes := []sample{}
+	neighbors := make([]int, 0, 8)
+	area := raw.Active
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			neighbors = neighbors[:0]
+			for dy := -2; dy <= 2; dy += 2 {
+				for dx := -2; dx <= 2; dx += 2 {
+					if (dx != 0 || dy != 0) && image.Pt(x+dx, y+dy).In(area) {
+						neighbors = append(neighbors, int(raw.Gray16At(x+dx, y+dy).Y))
+					}
+				}
+			}
+			if v, ok := outlier(int(raw.Gray16At(x, y).Y), neighbors, threshold); ok {
+				fixes = append(fixes, sample{x, y, v})
+			}
+		}
+	}
+	for _, f := range fixes {
+		i := raw.PixOffset(f.X, f.Y)
+		raw.Pix[i] = uint8(f.V >> 8)
+		raw.Pix[i+1] = uint8(f.V)
+	}
+	return nil
+}
+
+// Process fixes each component of the image, the neighbors of a pixel
+// being the eight around it
+func (filter *HotPixels) Process(img *FilterImage) error {
+	in := img.Image
+	out := image.NewRGBA64(in.Bounds())
+	copy(out.Pix, in.Pix)
+	bounds := in.Bounds()
+	threshold := int(0xFFFF * filter.Threshold / 100)
+	neighbors := make([]int, 0, 8)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := in.PixOffset(x, y)
+			for c := 0; c < 6; c += 2 {
+				neighbors = neighbors[:0]
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						if (dx != 0 || dy != 0) && image.Pt(x+dx, y+dy).In(bounds) {
+							j := in.PixOffset(x+dx, y+dy) + c
+							neighbors = append(neighbors, int(in.Pix[j])<<8|int(in.Pix[j+1]))
+						}
+					}
+				}
+				if v, ok := outlier(int(in.Pix[i+c])<<8|int(in.Pix[i+c+1]), neighbors, threshold); ok {
+					out.Pix[i+c] = uint8(v >> 8)
+					out.Pix[i+c+1] = uint8(v)
+				}
+			}
+		}
+	}
+	img.Image = out
+	return nil
+}
@@ -3,43 +3,85 @@ package filters
 import (
 	"errors"
 	"fmt"
-	"image"
 	"image/color"
 	_ "image/jpeg"
-	"os"
 )
 
 // Merge is a filter that merge the current image with the input image
 type Merge struct {
-	Image image.Image  // input image
+	Path      string       // path of the input image
+	Image     *FilterImage // input image, read by the first call to Process
+	Align     string       // registration of the input image, none, translation or rotation
+	Alignment Alignment    // alignment estimated for the last image
 }
 
-// NewMerge creates a new merge filter
-func NewMerge(argv[] string) (*Merge, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for merge, expected usage: merge <input>")
-	}
+// mergeSchema describes the parameters of merge
+var mergeSchema = &Schema{
+	Name: "merge",
+	Doc:  "adds the components of another image to the image",
+	Params: []*Param{
+		{Name: "input", Kind: PARAM_STRING, Doc: "path of the image to add"},
+		{Name: "align", Kind: PARAM_CHOICE, Choices: alignChoices, Default: ALIGN_NONE, Doc: "how the input is registered on the image before it is added"},
+	},
+}
 
-	reader, err := os.Open(argv[1])
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
-	}
-	defer reader.Close()
-	m, _, err := image.Decode(reader)
+func init() {
+	Register(mergeSchema, func(argv []string) (Filter, error) {
+		return NewMerge(argv)
+	})
+}
+
+// NewMerge creates a new merge filter
+func NewMerge(argv []string) (*Merge, error) {
+	args, err := mergeSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("can't decode input file: %s", err.Error()))
+		return nil, err
 	}
-
 	return &Merge{
-		m,
+		Path:  args.String("input"),
+		Align: args.String("align"),
 	}, nil
 }
 
+// Schema describes the parameters of the filter
+func (filter *Merge) Schema() *Schema {
+	return mergeSchema
+}
+
+// Report describes the alignment of the input image
+func (filter *Merge) Report() []string {
+	if filter.Align == ALIGN_NONE {
+		return nil
+	}
+	return []string{fmt.Sprintf("aligned %s", filter.Alignment)}
+}
+
 // Process merges the input image
 func (filter *Merge) Process(img *FilterImage) error {
+	if filter.Image == nil {
+		var err error
+		filter.Image, err = loadImage(filter.Path, img.Raw)
+		if err != nil {
+			return err
+		}
+	}
 	out := img.Image
 	bounds := out.Bounds()
-	inbounds := filter.Image.Bounds()
+	inbounds := filter.Image.Image.Bounds()
+
+	// both images must share the same encoding to be added
+	filter.Image.SetLinear(img.Linear)
+	input := filter.Image.Image
+
+	// areas the aligned input doesn't cover are left transparent, adding
+	// nothing to the image
+	if filter.Align != ALIGN_NONE {
+		if inbounds != bounds {
+			return errors.New(fmt.Sprintf("input is %v, image is %v, they can't be aligned", inbounds.Size(), bounds.Size()))
+		}
+		filter.Alignment = align(out, input, filter.Align)
+		input = warp(input, filter.Alignment, nil)
+	}
 
 	xmin := bounds.Min.X
 	if xmin < inbounds.Min.X {
@@ -61,7 +103,7 @@ func (filter *Merge) Process(img *FilterImage) error {
 	for x := xmin; x < xmax; x++ {
 		for y := ymin; y < ymax; y++ {
 			r, g, b, a := out.At(x, y).RGBA()
-			ir, ig, ib, ia := filter.Image.At(x, y).RGBA()
+			ir, ig, ib, ia := input.At(x, y).RGBA()
 
 			r = uint32(ClipInt(int(r + ir), 0, 0xFFFF))
 			g = uint32(ClipInt(int(g + ig), 0, 0xFFFF))
@@ -1,15 +1,63 @@
 package filters
 
-import "image"
+import (
+	"github.com/aimxhaisse/kodama/cr2"
+	"image"
+	"image/draw"
+)
 
 // Filters is a wrapper around images
 type FilterImage struct {
-	Image *image.RGBA64
+	Image     *image.RGBA64
+	Linear    bool // components are encoded in linear light instead of sRGB
+	Reference int  // longest side of the resolution absolute lengths are given for
+
+	Raw *cr2.DecodeOptions // how raw files read by filters are developed, defaults if nil
+
+	Exposure float64   // exposure time of the shot in seconds, 0 if unknown
+	Radiance []float32 // linear components merged by hdr, relative to Exposure and not clipped, nil otherwise
+}
+
+// NewFilterImage converts an sRGB image to a 16bits filter image
+func NewFilterImage(img image.Image) *FilterImage {
+	img64 := image.NewRGBA64(img.Bounds())
+	draw.Draw(img64, img64.Bounds(), img, img.Bounds().Min, draw.Src)
+	return &FilterImage{
+		Image: img64,
+	}
+}
+
+// Scaled returns a length in pixels along a dimension of size pixels.
+// Absolute lengths are scaled from the reference resolution to the image.
+func (img *FilterImage) Scaled(l Length, size int) float64 {
+	if l.Percent || img.Reference <= 0 {
+		return l.Pixels(size)
+	}
+	bounds := img.Image.Bounds()
+	return l.Value * float64(MaxInt(bounds.Dx(), bounds.Dy())) / float64(img.Reference)
 }
 
 // Filter processes an image
 type Filter interface {
 	Process(img *FilterImage) error
+	Schema() *Schema
+}
+
+// Reporter is a filter that describes what it measured on the last image
+// it processed, line by line
+type Reporter interface {
+	Report() []string
+}
+
+// Apply processes the image with a filter, the radiance merged by hdr
+// being dropped if the filter doesn't keep it up to date, so that tonemap
+// works on the components it changed
+func Apply(filter Filter, img *FilterImage) error {
+	err := filter.Process(img)
+	if _, ok := filter.(RadianceFilter); !ok {
+		img.Radiance = nil
+	}
+	return err
 }
 
 // ClipInt clips an integer between min and max
@@ -23,6 +71,14 @@ func ClipInt(i int, min int, max int) int {
 	return i
 }
 
+// MaxInt returns the greatest of two integers
+func MaxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 // Trunc truncates a color component to a 16bits value
 func Trunc(component uint32) uint16 {
 	if component > 0xFFFF {
@@ -0,0 +1,82 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/dng"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RawFilter is implemented by filters that process the sensor data of raw
+// inputs before they are developed, Process being used for other inputs
+type RawFilter interface {
+	ProcessRaw(raw *cr2.Raw) error
+}
+
+// IsRaw checks if the path names a raw file, by extension
+func IsRaw(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".cr2" || ext == ".dng"
+}
+
+// readCR2Raw reads the sensor data of a CR2 file, without reading it whole
+func readCR2Raw(file *os.File) (*cr2.Raw, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f, err := cr2.Open(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	return f.Raw()
+}
+
+// loadRaw reads the sensor data of a raw file
+func loadRaw(path string) (*cr2.Raw, error) {
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
+	}
+	defer reader.Close()
+	var raw *cr2.Raw
+	if strings.ToLower(filepath.Ext(path)) == ".dng" {
+		raw, err = dng.DecodeRaw(reader)
+	} else {
+		raw, err = readCR2Raw(reader)
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't decode input file: %s", err.Error()))
+	}
+	return raw, nil
+}
+
+// loadImage reads an image file as a filter image, raw files being
+// developed with the given options
+func loadImage(path string, opts *cr2.DecodeOptions) (*FilterImage, error) {
+	if IsRaw(path) {
+		raw, err := loadRaw(path)
+		if err != nil {
+			return nil, err
+		}
+		m, err := raw.Develop(opts)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't develop input file: %s", err.Error()))
+		}
+		return NewFilterImage(m), nil
+	}
+	reader, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't open input file: %s", err.Error()))
+	}
+	defer reader.Close()
+	m, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't decode input file: %s", err.Error()))
+	}
+	return NewFilterImage(m), nil
+}
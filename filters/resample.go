@@ -0,0 +1,180 @@
+package filters
+
+import (
+	"image"
+	"math"
+)
+
+// Kernel is a resampling filter
+type Kernel struct {
+	Support  float64                 // radius of the kernel, in samples
+	Adaptive bool                    // widen the kernel when downscaling
+	At       func(x float64) float64 // weight at distance x
+}
+
+// available kernels for resampling
+var Kernels = map[string]*Kernel{
+	"nearest":  {0.5, false, nearest},
+	"bilinear": {1, true, triangle},
+	"bicubic":  {2, true, catmullRom},
+	"lanczos":  {3, true, lanczos3},
+}
+
+// nearest picks the closest sample
+func nearest(x float64) float64 {
+	if x > -0.5 && x <= 0.5 {
+		return 1
+	}
+	return 0
+}
+
+// triangle interpolates linearly between the two closest samples
+func triangle(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1 - x
+	}
+	return 0
+}
+
+// catmullRom is the bicubic kernel with a = -0.5
+func catmullRom(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return (1.5*x-2.5)*x*x + 1
+	}
+	if x < 2 {
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+// sinc is the normalized cardinal sine
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// lanczos3 is a windowed sinc with 3 lobes
+func lanczos3(x float64) float64 {
+	if x > -3 && x < 3 {
+		return sinc(x) * sinc(x/3)
+	}
+	return 0
+}
+
+// contribution holds the weights of source samples for one output sample
+type contribution struct {
+	Start   int
+	Weights []float64
+}
+
+// computeContributions maps n output samples on the source window
+// starting at offset and of the given length, in a source of size samples
+func computeContributions(k *Kernel, size int, offset float64, length float64, n int) []contribution {
+	scale := length / float64(n)
+	filter_scale := 1.0
+	if k.Adaptive && scale > 1 {
+		filter_scale = scale
+	}
+	support := k.Support * filter_scale
+
+	res := make([]contribution, n)
+	for i := range res {
+		center := offset + (float64(i)+0.5)*scale
+		start := ClipInt(int(math.Floor(center-support)), 0, size-1)
+		end := ClipInt(int(math.Ceil(center+support)), start+1, size)
+
+		weights := make([]float64, end-start)
+		sum := 0.0
+		for j := start; j < end; j++ {
+			w := k.At((float64(j) + 0.5 - center) / filter_scale)
+			weights[j-start] = w
+			sum += w
+		}
+		if sum == 0 {
+			// window is out of the source, use the closest sample
+			start = ClipInt(int(center), 0, size-1)
+			weights = []float64{1}
+			sum = 1
+		}
+		for j := range weights {
+			weights[j] /= sum
+		}
+		res[i] = contribution{start, weights}
+	}
+	return res
+}
+
+// Resample returns a w*h image computed from the window of the input
+// image starting at (x, y) and of size (dx, dy), in source pixels
+func Resample(in *image.RGBA64, k *Kernel, x, y, dx, dy float64, w, h int) *image.RGBA64 {
+	bounds := in.Bounds()
+	cols := computeContributions(k, bounds.Dx(), x, dx, w)
+	rows := computeContributions(k, bounds.Dy(), y, dy, h)
+
+	// only source rows used by the vertical pass are needed
+	row_min := rows[0].Start
+	row_max := rows[0].Start + len(rows[0].Weights)
+	for _, c := range rows {
+		if c.Start < row_min {
+			row_min = c.Start
+		}
+		if c.Start+len(c.Weights) > row_max {
+			row_max = c.Start + len(c.Weights)
+		}
+	}
+
+	// horizontal pass, from the input to a float buffer (4 components per pixel)
+	tmp := make([]float32, (row_max-row_min)*w*4)
+	for sy := row_min; sy < row_max; sy++ {
+		line := tmp[(sy-row_min)*w*4:]
+		for ox, c := range cols {
+			var acc [4]float64
+			i := in.PixOffset(bounds.Min.X+c.Start, bounds.Min.Y+sy)
+			for _, wt := range c.Weights {
+				pix := in.Pix[i : i+8 : i+8]
+				acc[0] += wt * float64(uint16(pix[0])<<8|uint16(pix[1]))
+				acc[1] += wt * float64(uint16(pix[2])<<8|uint16(pix[3]))
+				acc[2] += wt * float64(uint16(pix[4])<<8|uint16(pix[5]))
+				acc[3] += wt * float64(uint16(pix[6])<<8|uint16(pix[7]))
+				i += 8
+			}
+			for j := 0; j < 4; j++ {
+				line[ox*4+j] = float32(acc[j])
+			}
+		}
+	}
+
+	// vertical pass, from the float buffer to the output
+	out := image.NewRGBA64(image.Rect(0, 0, w, h))
+	for oy, c := range rows {
+		for ox := 0; ox < w; ox++ {
+			var acc [4]float64
+			for j, wt := range c.Weights {
+				s := tmp[((c.Start+j-row_min)*w+ox)*4:]
+				acc[0] += wt * float64(s[0])
+				acc[1] += wt * float64(s[1])
+				acc[2] += wt * float64(s[2])
+				acc[3] += wt * float64(s[3])
+			}
+
+			// kernels with negative lobes may overshoot, and
+			// premultiplied components can't exceed alpha
+			a := ClipInt(int(acc[3]+0.5), 0, 0xFFFF)
+			i := out.PixOffset(ox, oy)
+			pix := out.Pix[i : i+8 : i+8]
+			for j := 0; j < 3; j++ {
+				v := ClipInt(int(acc[j]+0.5), 0, a)
+				pix[j*2] = uint8(v >> 8)
+				pix[j*2+1] = uint8(v)
+			}
+			pix[6] = uint8(a >> 8)
+			pix[7] = uint8(a)
+		}
+	}
+	return out
+}
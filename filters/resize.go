@@ -2,58 +2,139 @@ package filters
 
 import (
 	"errors"
-	"fmt"
 	"image"
-	"strconv"
+	"image/draw"
+	"math"
 )
 
 // Resize is a filter that resizes the input image
 type Resize struct {
-	Width  int // new width
-	Height int // new height
+	Width   Length  // new width (0 to keep the aspect ratio)
+	Height  Length  // new height (0 to keep the aspect ratio)
+	Kernel  *Kernel // resampling kernel
+	Mode    string  // how the image fits the new dimensions
+	Gravity string  // where the image is anchored when cropped or padded
+}
+
+// available gravities, as horizontal and vertical anchors
+var gravities = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"south":     {0.5, 1},
+	"east":      {1, 0.5},
+	"west":      {0, 0.5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// resizeSchema describes the parameters of resize, available modes are:
+//
+//   - stretch: the image gets the exact dimensions
+//   - fit: the image fits in the dimensions, keeping its aspect ratio
+//   - fill: same as fit, padded to the exact dimensions
+//   - cover: the image covers the dimensions, cropped to the exact dimensions
+var resizeSchema = &Schema{
+	Name: "resize",
+	Doc:  "resizes the image",
+	Params: []*Param{
+		{Name: "width", Kind: PARAM_LENGTH, Range: Positive, Auto: true, Doc: "new width, in pixels or % of the width, _ keeps the aspect ratio"},
+		{Name: "height", Kind: PARAM_LENGTH, Range: Positive, Auto: true, Doc: "new height, in pixels or % of the height, _ keeps the aspect ratio"},
+		{Name: "kernel", Kind: PARAM_CHOICE, Default: "lanczos", Choices: []string{"nearest", "bilinear", "bicubic", "lanczos"}, Doc: "resampling kernel"},
+		{Name: "mode", Kind: PARAM_CHOICE, Default: "stretch", Choices: []string{"stretch", "fit", "fill", "cover"}, Doc: "how the image fits the new dimensions"},
+		{Name: "gravity", Kind: PARAM_CHOICE, Default: "center", Choices: []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest"}, Doc: "where the image is anchored when cropped or padded"},
+	},
+}
+
+func init() {
+	Register(resizeSchema, func(argv []string) (Filter, error) {
+		return NewResize(argv)
+	})
 }
 
 // NewResize creates a new filter for resizing
 func NewResize(argv []string) (*Resize, error) {
-	if len(argv) != 3 {
-		return nil, errors.New("invalid syntax for resize, expected usage: resize <width> <height>")
-	}
-	w, err := strconv.Atoi(argv[1])
+	args, err := resizeSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for width: %s", err.Error()))
+		return nil, err
 	}
-	h, err := strconv.Atoi(argv[2])
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for height: %s", err.Error()))
-	}
-
-	if w <= 0 {
-		return nil, errors.New("parameter 'width' must be > 0")
-	}
-	if h <= 0 {
-		return nil, errors.New("parameter 'height' must be > 0")
+	w := args.Length("width")
+	h := args.Length("height")
+	if w.Value == 0 && h.Value == 0 {
+		return nil, errors.New("parameters 'width' and 'height' of resize can't both be _")
 	}
 
 	return &Resize{
 		w,
 		h,
+		Kernels[args.String("kernel")],
+		args.String("mode"),
+		args.String("gravity"),
 	}, nil
 }
 
+// Schema describes the parameters of the filter
+func (filter *Resize) Schema() *Schema {
+	return resizeSchema
+}
+
 // Process resizes the input image
 func (filter *Resize) Process(img *FilterImage) error {
 	in := img.Image
 	bounds := in.Bounds()
-	out := image.NewRGBA64(image.Rect(0, 0, filter.Width, filter.Height))
-	ratio_x := float64(bounds.Max.X) / float64(filter.Width)
-	ratio_y := float64(bounds.Max.Y) / float64(filter.Height)
-	for x := 0; x < filter.Width; x++ {
-		for y := 0; y < filter.Height; y++ {
-			in_x := int(ratio_x * float64(x))
-			in_y := int(ratio_y * float64(y))
-			out.Set(x, y, in.At(in_x, in_y))
-		}
+	in_w := float64(bounds.Dx())
+	in_h := float64(bounds.Dy())
+	if in_w == 0 || in_h == 0 {
+		return errors.New("can't resize an empty image")
 	}
-	img.Image = out
+
+	// unspecified dimensions keep the aspect ratio
+	w := math.Max(1, math.Floor(filter.Width.Pixels(bounds.Dx())+0.5))
+	h := math.Max(1, math.Floor(filter.Height.Pixels(bounds.Dy())+0.5))
+	if filter.Width.Value == 0 {
+		w = math.Max(1, math.Floor(in_w*h/in_h+0.5))
+	}
+	if filter.Height.Value == 0 {
+		h = math.Max(1, math.Floor(in_h*w/in_w+0.5))
+	}
+
+	gravity := gravities[filter.Gravity]
+	scale_x := w / in_w
+	scale_y := h / in_h
+
+	switch filter.Mode {
+
+	case "fit":
+		scale := math.Min(scale_x, scale_y)
+		out_w := int(math.Max(1, math.Floor(in_w*scale+0.5)))
+		out_h := int(math.Max(1, math.Floor(in_h*scale+0.5)))
+		img.Image = Resample(in, filter.Kernel, 0, 0, in_w, in_h, out_w, out_h)
+
+	case "fill":
+		scale := math.Min(scale_x, scale_y)
+		out_w := int(math.Max(1, math.Floor(in_w*scale+0.5)))
+		out_h := int(math.Max(1, math.Floor(in_h*scale+0.5)))
+		resized := Resample(in, filter.Kernel, 0, 0, in_w, in_h, out_w, out_h)
+
+		// pad with transparent pixels, anchored by gravity
+		out := image.NewRGBA64(image.Rect(0, 0, int(w), int(h)))
+		offset := image.Pt(int((float64(int(w)-out_w))*gravity[0]), int((float64(int(h)-out_h))*gravity[1]))
+		draw.Draw(out, resized.Bounds().Add(offset), resized, image.Point{0, 0}, draw.Src)
+		img.Image = out
+
+	case "cover":
+		// crop the source window, anchored by gravity
+		scale := math.Max(scale_x, scale_y)
+		dx := w / scale
+		dy := h / scale
+		x := (in_w - dx) * gravity[0]
+		y := (in_h - dy) * gravity[1]
+		img.Image = Resample(in, filter.Kernel, x, y, dx, dy, int(w), int(h))
+
+	default:
+		img.Image = Resample(in, filter.Kernel, 0, 0, in_w, in_h, int(w), int(h))
+	}
+
 	return nil
 }
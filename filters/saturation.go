@@ -1,38 +1,53 @@
 package filters
 
 import (
-	"errors"
-	"fmt"
 	"image/color"
-	"strconv"
 )
 
 // Saturation is a filter that modifies the saturation of the image
 type Saturation struct {
-	Strength uint32 // Percentage of saturation to apply
+	Strength float64 // Percentage of saturation to apply (negative desaturates)
 }
 
-// NewSaturation creates a new filter for darkness
+// saturationSchema describes the parameters of saturation
+var saturationSchema = &Schema{
+	Name: "saturation",
+	Doc:  "modifies the saturation of the image",
+	Params: []*Param{
+		{Name: "strength", Kind: PARAM_PERCENT, Doc: "percentage of saturation to add, negative desaturates"},
+	},
+}
+
+func init() {
+	Register(saturationSchema, func(argv []string) (Filter, error) {
+		return NewSaturation(argv)
+	})
+}
+
+// NewSaturation creates a new filter for saturation
 func NewSaturation(argv []string) (*Saturation, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for saturation, expected usage: saturation <strength>")
-	}
-	strength, err := strconv.Atoi(argv[1])
+	args, err := saturationSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for saturation: %s", err.Error()))
+		return nil, err
 	}
-	if strength > 0 {
-		return &Saturation{
-			uint32(strength),
-		}, nil
-	}
-	return nil, errors.New("parameter 'strength' must be > 0")
+	return &Saturation{
+		args.Float("strength"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *Saturation) Schema() *Schema {
+	return saturationSchema
 }
 
 // This filter is scalable
 func (filter *Saturation) IsScalable() {
 }
 
+// This filter works on sRGB components
+func (filter *Saturation) IsPerceptual() {
+}
+
 // Process applies a saturation filter to the image
 func (filter *Saturation) Process(img *FilterImage) error {
 	out := img.Image
@@ -43,9 +58,17 @@ func (filter *Saturation) Process(img *FilterImage) error {
 
 			grey := (r + g + b) / 3
 
-			nr := Trunc(r + ((Abs(int32(r-grey)) * filter.Strength) / 100))
-			ng := Trunc(g + ((Abs(int32(g-grey)) * filter.Strength) / 100))
-			nb := Trunc(b + ((Abs(int32(b-grey)) * filter.Strength) / 100))
+			var nr, ng, nb uint16
+			if filter.Strength >= 0 {
+				nr = Trunc(r + uint32(float64(Abs(int32(r-grey)))*filter.Strength/100))
+				ng = Trunc(g + uint32(float64(Abs(int32(g-grey)))*filter.Strength/100))
+				nb = Trunc(b + uint32(float64(Abs(int32(b-grey)))*filter.Strength/100))
+			} else {
+				// move components towards grey
+				nr = Strunc(int32(r) + int32(float64(int32(grey)-int32(r))*-filter.Strength/100))
+				ng = Strunc(int32(g) + int32(float64(int32(grey)-int32(g))*-filter.Strength/100))
+				nb = Strunc(int32(b) + int32(float64(int32(grey)-int32(b))*-filter.Strength/100))
+			}
 
 			nc := color.NRGBA64{nr, ng, nb, uint16(a)}
 			out.Set(x, y, nc)
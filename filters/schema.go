@@ -0,0 +1,304 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// available kinds for a Param
+const (
+	PARAM_INT = iota
+	PARAM_FLOAT
+	PARAM_PERCENT
+	PARAM_LENGTH
+	PARAM_STRING
+	PARAM_CHOICE
+)
+
+// names of the kinds, as shown to users
+var kindNames = map[int]string{
+	PARAM_INT:     "integer",
+	PARAM_FLOAT:   "number",
+	PARAM_PERCENT: "percentage",
+	PARAM_LENGTH:  "length",
+	PARAM_STRING:  "string",
+	PARAM_CHOICE:  "choice",
+}
+
+// Range bounds the value of a numeric parameter
+type Range struct {
+	Min    float64
+	Max    float64
+	Strict bool // Min is excluded
+}
+
+// Positive is the range of strictly positive values
+var Positive = &Range{0, math.Inf(1), true}
+
+// String describes the range
+func (r *Range) String() string {
+	if math.IsInf(r.Max, 1) {
+		if r.Strict {
+			return fmt.Sprintf("> %g", r.Min)
+		}
+		return fmt.Sprintf(">= %g", r.Min)
+	}
+	if r.Strict {
+		return fmt.Sprintf("in ]%g, %g]", r.Min, r.Max)
+	}
+	return fmt.Sprintf("in [%g, %g]", r.Min, r.Max)
+}
+
+// Contains checks if v is in the range
+func (r *Range) Contains(v float64) bool {
+	if r.Strict && v <= r.Min {
+		return false
+	}
+	return v >= r.Min && v <= r.Max
+}
+
+// Param describes a parameter of a filter
+type Param struct {
+	Name    string
+	Kind    int
+	Doc     string
+	Default string   // default value, empty if the parameter is required
+	Range   *Range   // bounds of numeric values, nil if unbounded
+	Choices []string // allowed values of a PARAM_CHOICE
+	Auto    bool     // _ is accepted for a PARAM_LENGTH, and gives a zero length
+
+	// the parameter takes all the remaining positional values, as a
+	// []string, following parameters can only be given by name
+	Variadic bool
+}
+
+// KindName returns the name of the kind of the parameter
+func (p *Param) KindName() string {
+	return kindNames[p.Kind]
+}
+
+// parse parses the value of the parameter for filter
+func (p *Param) parse(filter string, arg string) (interface{}, error) {
+	var v interface{}
+	var num float64
+	var err error
+
+	switch p.Kind {
+
+	case PARAM_INT:
+		var i int
+		i, err = ParseInt(filter, p.Name, arg)
+		v, num = i, float64(i)
+
+	case PARAM_FLOAT:
+		num, err = ParseFloat(filter, p.Name, arg)
+		v = num
+
+	case PARAM_PERCENT:
+		num, err = ParsePercent(filter, p.Name, arg)
+		v = num
+
+	case PARAM_LENGTH:
+		if p.Auto && arg == "_" {
+			return Length{}, nil
+		}
+		var l Length
+		l, err = ParseLength(filter, p.Name, arg)
+		v, num = l, l.Value
+
+	case PARAM_CHOICE:
+		for _, c := range p.Choices {
+			if c == arg {
+				return arg, nil
+			}
+		}
+		return nil, paramError(filter, p.Name, "expected one of %s, got '%s'", strings.Join(p.Choices, "|"), arg)
+
+	default:
+		return arg, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if p.Range != nil && !p.Range.Contains(num) {
+		return nil, paramError(filter, p.Name, "must be %s", p.Range.String())
+	}
+	return v, nil
+}
+
+// Schema describes a filter and its parameters
+type Schema struct {
+	Name   string
+	Doc    string
+	Params []*Param
+}
+
+// Usage returns the syntax of the filter
+func (s *Schema) Usage() string {
+	usage := []string{s.Name}
+	for _, p := range s.Params {
+		name := p.Name
+		if p.Kind == PARAM_CHOICE {
+			name = strings.Join(p.Choices, "|")
+		}
+		if p.Variadic {
+			usage = append(usage, fmt.Sprintf("<%s...>", name))
+		} else if p.Default == "" {
+			usage = append(usage, fmt.Sprintf("<%s>", name))
+		} else {
+			usage = append(usage, fmt.Sprintf("[%s=%s]", p.Name, p.Default))
+		}
+	}
+	return strings.Join(usage, " ")
+}
+
+// Args contains the parsed parameters of a filter, by name
+type Args map[string]interface{}
+
+// Int returns the value of an integer parameter
+func (a Args) Int(name string) int {
+	return a[name].(int)
+}
+
+// Float returns the value of a number or percentage parameter
+func (a Args) Float(name string) float64 {
+	return a[name].(float64)
+}
+
+// Length returns the value of a length parameter
+func (a Args) Length(name string) Length {
+	return a[name].(Length)
+}
+
+// String returns the value of a string or choice parameter
+func (a Args) String(name string) string {
+	return a[name].(string)
+}
+
+// Strings returns the values of a variadic parameter
+func (a Args) Strings(name string) []string {
+	return a[name].([]string)
+}
+
+// Parse parses the arguments of a filter, including its name. Parameters
+// are given by position, then by name as name=value; arguments whose name
+// isn't a parameter are positional, such as paths holding a =.
+func (s *Schema) Parse(argv []string) (Args, error) {
+	res := Args{}
+	values := map[string]string{}
+	keywords := false
+	position := 0
+	rest := []string{}
+
+	for _, arg := range argv[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 2 && s.param(kv[0]) != nil {
+			if _, ok := values[kv[0]]; ok {
+				return nil, errors.New(fmt.Sprintf("parameter '%s' for %s is given twice", kv[0], s.Name))
+			}
+			values[kv[0]] = kv[1]
+			keywords = true
+			continue
+		}
+		if keywords {
+			return nil, errors.New(fmt.Sprintf("positional parameter '%s' after named ones for %s, expected usage: %s", arg, s.Name, s.Usage()))
+		}
+		if position >= len(s.Params) {
+			return nil, errors.New(fmt.Sprintf("invalid syntax for %s, expected usage: %s", s.Name, s.Usage()))
+		}
+		if s.Params[position].Variadic {
+			rest = append(rest, arg)
+			continue
+		}
+		values[s.Params[position].Name] = arg
+		position++
+	}
+
+	for _, p := range s.Params {
+		arg, ok := values[p.Name]
+		if p.Variadic {
+			if ok {
+				rest = append(rest, arg)
+			}
+			if len(rest) == 0 {
+				return nil, errors.New(fmt.Sprintf("missing parameter '%s' for %s, expected usage: %s", p.Name, s.Name, s.Usage()))
+			}
+			res[p.Name] = rest
+			continue
+		}
+		if !ok {
+			if p.Default == "" {
+				return nil, errors.New(fmt.Sprintf("missing parameter '%s' for %s, expected usage: %s", p.Name, s.Name, s.Usage()))
+			}
+			arg = p.Default
+		}
+		v, err := p.parse(s.Name, arg)
+		if err != nil {
+			return nil, err
+		}
+		res[p.Name] = v
+	}
+
+	return res, nil
+}
+
+// param returns the parameter called name, or nil
+func (s *Schema) param(name string) *Param {
+	for _, p := range s.Params {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// Constructor creates a filter from its arguments, including its name
+type Constructor func(argv []string) (Filter, error)
+
+// registration associates a schema to the constructor of its filter
+type registration struct {
+	schema *Schema
+	ctor   Constructor
+}
+
+// registered filters, by name
+var registry = map[string]registration{}
+
+// Register makes a filter available to scripts
+func Register(schema *Schema, ctor Constructor) {
+	registry[schema.Name] = registration{schema, ctor}
+}
+
+// Lookup returns the schema of a registered filter, or nil
+func Lookup(name string) *Schema {
+	return registry[name].schema
+}
+
+// Schemas returns the schemas of all registered filters, sorted by name
+func Schemas() []*Schema {
+	res := []*Schema{}
+	for _, r := range registry {
+		res = append(res, r.schema)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// New creates the filter named by the first argument
+func New(argv []string) (Filter, error) {
+	r, ok := registry[argv[0]]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown filter: %s", argv[0]))
+	}
+	f, err := r.ctor(argv)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,41 @@
+package filters
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePathsWithEquals(t *testing.T) {
+	args, err := mergeSchema.Parse([]string{"merge", "shots/a=1.jpg", "align=translation"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args.String("input") != "shots/a=1.jpg" || args.String("align") != ALIGN_TRANSLATION {
+		t.Errorf("got input %q and align %q", args.String("input"), args.String("align"))
+	}
+
+	args, err = hdrSchema.Parse([]string{"hdr", "ev=-2.jpg", "ev=2.jpg", "exposures=1/125,1/500,1/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames := args.Strings("frames"); !reflect.DeepEqual(frames, []string{"ev=-2.jpg", "ev=2.jpg"}) {
+		t.Errorf("got frames %q", frames)
+	}
+	if args.String("exposures") != "1/125,1/500,1/30" {
+		t.Errorf("got exposures %q", args.String("exposures"))
+	}
+}
+
+func TestParseNamed(t *testing.T) {
+	args, err := blurSchema.Parse([]string{"blur", "radius=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := args.Length("radius"); r.Value != 2 || r.Percent {
+		t.Errorf("got radius %v", r)
+	}
+	_, err = blurSchema.Parse([]string{"blur", "radius=2", "radius=3"})
+	if err == nil {
+		t.Error("radius given twice was accepted")
+	}
+}
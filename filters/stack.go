@@ -0,0 +1,258 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// memory used by the frames of a band of rows, when stacking them
+const stackBandBytes = 64 << 20
+
+// Stack is a filter that combines the image with other frames of the same
+// scene to reduce noise
+type Stack struct {
+	Mode   string   // mean, median or sigma (mean of the values within kappa standard deviations)
+	Frames []string // paths of the frames
+	Kappa  float64
+	Align  string // registration of the frames, none, translation or rotation
+
+	// alignments estimated for the frames of the last image
+	Alignments []Alignment
+}
+
+// stackSchema describes the parameters of stack
+var stackSchema = &Schema{
+	Name: "stack",
+	Doc:  "combines the image with other frames, in linear light",
+	Params: []*Param{
+		{Name: "mode", Kind: PARAM_CHOICE, Choices: []string{"mean", "median", "sigma"}, Doc: "how values of a pixel are combined"},
+		{Name: "frames", Kind: PARAM_STRING, Variadic: true, Doc: "paths or glob patterns of the frames"},
+		{Name: "kappa", Kind: PARAM_FLOAT, Range: Positive, Default: "2.5", Doc: "standard deviations values are kept within, in sigma mode"},
+		{Name: "align", Kind: PARAM_CHOICE, Choices: alignChoices, Default: ALIGN_NONE, Doc: "how frames are registered on the image before they are combined"},
+	},
+}
+
+func init() {
+	Register(stackSchema, func(argv []string) (Filter, error) {
+		return NewStack(argv)
+	})
+}
+
+// NewStack creates a new filter for stack, expanding glob patterns
+func NewStack(argv []string) (*Stack, error) {
+	args, err := stackSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	res := &Stack{Mode: args.String("mode"), Kappa: args.Float("kappa"), Align: args.String("align")}
+	for _, pattern := range args.Strings("frames") {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid pattern %s: %s", pattern, err.Error()))
+		}
+		if len(paths) == 0 {
+			return nil, errors.New(fmt.Sprintf("no frame matches %s", pattern))
+		}
+		res.Frames = append(res.Frames, paths...)
+	}
+	return res, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *Stack) Schema() *Schema {
+	return stackSchema
+}
+
+// Report describes the alignments of the frames
+func (filter *Stack) Report() []string {
+	if filter.Align == ALIGN_NONE {
+		return nil
+	}
+	res := []string{}
+	for i, a := range filter.Alignments {
+		res = append(res, fmt.Sprintf("%s aligned %s", filter.Frames[i], a))
+	}
+	return res
+}
+
+// loadFrame reads a frame, which must have the dimensions of the image,
+// and aligns it on the image; areas the aligned frame doesn't cover are
+// taken from the image
+func (filter *Stack) loadFrame(path string, img *FilterImage) (*FilterImage, error) {
+	frame, err := loadImage(path, img.Raw)
+	if err != nil {
+		return nil, err
+	}
+	if frame.Image.Bounds() != img.Image.Bounds() {
+		return nil, errors.New(fmt.Sprintf("frame %s is %v, image is %v", path, frame.Image.Bounds().Size(), img.Image.Bounds().Size()))
+	}
+	frame.SetLinear(true)
+	if filter.Align != ALIGN_NONE {
+		a := align(img.Image, frame.Image, filter.Align)
+		filter.Alignments = append(filter.Alignments, a)
+		frame.Image = warp(frame.Image, a, img.Image)
+	}
+	return frame, nil
+}
+
+// Process stacks the frames, one at a time for the mean, and by bands of
+// rows of all the frames otherwise, the frames being spooled to a
+// temporary file so that only one of them is decoded in memory at once
+func (filter *Stack) Process(img *FilterImage) error {
+	linear := img.Linear
+	img.SetLinear(true)
+	filter.Alignments = nil
+	var err error
+	if filter.Mode == "mean" {
+		err = filter.mean(img)
+	} else {
+		err = filter.bands(img)
+	}
+	img.SetLinear(linear)
+	return err
+}
+
+// mean averages the frames, accumulated one by one
+func (filter *Stack) mean(img *FilterImage) error {
+	out := img.Image
+	sums := make([]uint32, len(out.Pix)/8*3)
+	add := func(pix []uint8) {
+		for i := range sums {
+			j := 8*(i/3) + 2*(i%3)
+			sums[i] += uint32(pix[j])<<8 | uint32(pix[j+1])
+		}
+	}
+	add(out.Pix)
+	for _, path := range filter.Frames {
+		frame, err := filter.loadFrame(path, img)
+		if err != nil {
+			return err
+		}
+		add(frame.Image.Pix)
+	}
+	n := uint32(len(filter.Frames) + 1)
+	for i := range sums {
+		j := 8*(i/3) + 2*(i%3)
+		v := Trunc((sums[i] + n/2) / n)
+		out.Pix[j] = uint8(v >> 8)
+		out.Pix[j+1] = uint8(v)
+	}
+	return nil
+}
+
+// median returns the median of sorted values
+func median(values []float64) float64 {
+	n := len(values)
+	if n%2 == 0 {
+		return (values[n/2-1] + values[n/2]) / 2
+	}
+	return values[n/2]
+}
+
+// combine returns the median of values, or the mean of those within kappa
+// standard deviations of the median, rejecting values until none is left
+// out or all would be, the median being kept then; values are sorted
+func combine(values []float64, mode string, kappa float64) float64 {
+	sort.Float64s(values)
+	if mode == "median" {
+		return median(values)
+	}
+	lo, hi := 0, len(values)
+	for hi-lo > 2 {
+		kept := values[lo:hi]
+		sum, sum2 := 0.0, 0.0
+		for _, v := range kept {
+			sum += v
+			sum2 += v * v
+		}
+		mean := sum / float64(len(kept))
+		sigma := math.Sqrt(math.Max(sum2/float64(len(kept))-mean*mean, 0))
+		center := median(kept)
+		nlo, nhi := lo, hi
+		for values[nlo] < center-kappa*sigma {
+			nlo++
+		}
+		for values[nhi-1] > center+kappa*sigma {
+			nhi--
+		}
+		if nlo == lo && nhi == hi {
+			break
+		}
+		// with an even number of values, both middle ones can be
+		// rejected: the window collapses to their median
+		if nlo >= nhi {
+			return center
+		}
+		lo, hi = nlo, nhi
+	}
+	sum := 0.0
+	for _, v := range values[lo:hi] {
+		sum += v
+	}
+	return sum / float64(hi-lo)
+}
+
+// bands combines the values of each pixel of all the frames, spooled to
+// a temporary file then read back by bands of rows
+func (filter *Stack) bands(img *FilterImage) error {
+	out := img.Image
+	bounds := out.Bounds()
+	row := 8 * bounds.Dx()
+	size := int64(row * bounds.Dy())
+
+	spool, err := ioutil.TempFile("", "kodama-stack-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	for i, path := range filter.Frames {
+		frame, err := filter.loadFrame(path, img)
+		if err != nil {
+			return err
+		}
+		_, err = spool.WriteAt(frame.Image.Pix, int64(i)*size)
+		if err != nil {
+			return err
+		}
+	}
+
+	n := len(filter.Frames) + 1
+	rows := MaxInt(1, stackBandBytes/(n*row))
+	band := make([]uint8, rows*row*len(filter.Frames))
+	values := make([]float64, n)
+	for y := 0; y < bounds.Dy(); y += rows {
+		h := rows
+		if y+h > bounds.Dy() {
+			h = bounds.Dy() - y
+		}
+		length := h * row
+		for i := range filter.Frames {
+			_, err = spool.ReadAt(band[i*length:(i+1)*length], int64(i)*size+int64(y*row))
+			if err != nil {
+				return err
+			}
+		}
+		start := y * row
+		for j := 0; j < length; j += 2 {
+			// alpha is kept
+			if j%8 == 6 {
+				continue
+			}
+			values[0] = float64(int(out.Pix[start+j])<<8 | int(out.Pix[start+j+1]))
+			for i := range filter.Frames {
+				k := i*length + j
+				values[i+1] = float64(int(band[k])<<8 | int(band[k+1]))
+			}
+			v := Trunc(uint32(combine(values, filter.Mode, filter.Kappa) + 0.5))
+			out.Pix[start+j] = uint8(v >> 8)
+			out.Pix[start+j+1] = uint8(v)
+		}
+	}
+	return nil
+}
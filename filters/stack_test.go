@@ -0,0 +1,27 @@
+package filters
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCombineSigma(t *testing.T) {
+	tests := []struct {
+		values []float64
+		kappa  float64
+		want   float64
+	}{
+		{[]float64{10, 11, 12, 13, 100}, 1, 11.5},
+		{[]float64{12, 12, 12}, 0.5, 12},
+		// both middle values are rejected at once
+		{[]float64{0, 14, 16, 30}, 0.05, 15},
+		{[]float64{30, 16, 0, 14}, 0.01, 15},
+	}
+	for _, test := range tests {
+		values := append([]float64{}, test.values...)
+		got := combine(values, "sigma", test.kappa)
+		if math.IsNaN(got) || math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("combine(%v, sigma, %v) = %v, want %v", test.values, test.kappa, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package filters
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// luminance the log-average luminance of the image is mapped to, before
+// the exposure is applied
+const toneMapKey = 0.18
+
+// white point and exposure bias of the filmic curve
+const (
+	filmicWhite = 11.2
+	filmicBias  = 2.0
+)
+
+// ToneMap is a filter that compresses the radiance merged by hdr (or the
+// linear components of the image) to a displayable range
+type ToneMap struct {
+	Operator string  // reinhard or filmic
+	Exposure float64 // in EV, added to the automatic exposure
+}
+
+// toneMapSchema describes the parameters of tonemap
+var toneMapSchema = &Schema{
+	Name: "tonemap",
+	Doc:  "compresses the range of the radiance merged by hdr to display it",
+	Params: []*Param{
+		{Name: "operator", Kind: PARAM_CHOICE, Choices: []string{"reinhard", "filmic"}, Doc: "curve the radiance is mapped with"},
+		{Name: "exposure", Kind: PARAM_FLOAT, Range: &Range{-10, 10, false}, Default: "0", Doc: "exposure compensation in EV, added to the automatic exposure"},
+	},
+}
+
+func init() {
+	Register(toneMapSchema, func(argv []string) (Filter, error) {
+		return NewToneMap(argv)
+	})
+}
+
+// NewToneMap creates a new filter for tonemap
+func NewToneMap(argv []string) (*ToneMap, error) {
+	args, err := toneMapSchema.Parse(argv)
+	if err != nil {
+		return nil, err
+	}
+	return &ToneMap{
+		args.String("operator"),
+		args.Float("exposure"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *ToneMap) Schema() *Schema {
+	return toneMapSchema
+}
+
+// hable is the filmic curve of John Hable
+func hable(x float64) float64 {
+	const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+	return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+}
+
+// luminance returns the relative luminance of linear sRGB components
+func luminance(r float64, g float64, b float64) float64 {
+	return 0.2126*r + 0.7152*g + 0.0722*b
+}
+
+// Process maps the radiance in linear light, after it is scaled so that
+// its log-average luminance is a middle gray. Reinhard's operator scales
+// the components by the compressed luminance, the brightest value being
+// mapped to white; the filmic curve compresses each component on its own,
+// with a toe and a shoulder.
+func (filter *ToneMap) Process(img *FilterImage) error {
+	linear := img.Linear
+	img.SetLinear(true)
+	defer img.SetLinear(linear)
+
+	out := img.Image
+	n := len(out.Pix) / 8
+	radiance := img.Radiance
+	if radiance == nil {
+		radiance = make([]float32, 3*n)
+		for p := 0; p < n; p++ {
+			for c := 0; c < 3; c++ {
+				i := 8*p + 2*c
+				radiance[3*p+c] = float32(int(out.Pix[i])<<8|int(out.Pix[i+1])) / 0xFFFF
+			}
+		}
+	}
+	if len(radiance) != 3*n {
+		return errors.New(fmt.Sprintf("radiance doesn't match the image (%v), tonemap must follow hdr", out.Bounds().Size()))
+	}
+
+	sum, white := 0.0, 0.0
+	for p := 0; p < n; p++ {
+		l := luminance(float64(radiance[3*p]), float64(radiance[3*p+1]), float64(radiance[3*p+2]))
+		sum += math.Log(1e-6 + l)
+		white = math.Max(white, l)
+	}
+	scale := toneMapKey / math.Exp(sum/float64(n)) * math.Pow(2, filter.Exposure)
+	white *= scale
+
+	values := [3]float64{}
+	for p := 0; p < n; p++ {
+		for c := 0; c < 3; c++ {
+			values[c] = float64(radiance[3*p+c]) * scale
+		}
+		if filter.Operator == "reinhard" {
+			l := luminance(values[0], values[1], values[2])
+			if l > 0 {
+				ratio := (1 + l/(white*white)) / (1 + l)
+				for c := 0; c < 3; c++ {
+					values[c] *= ratio
+				}
+			}
+		} else {
+			for c := 0; c < 3; c++ {
+				values[c] = hable(values[c]*filmicBias) / hable(filmicWhite)
+			}
+		}
+		for c := 0; c < 3; c++ {
+			i := 8*p + 2*c
+			v := Trunc(uint32(math.Max(0, math.Min(values[c]*0xFFFF+0.5, 0xFFFF))))
+			out.Pix[i] = uint8(v >> 8)
+			out.Pix[i+1] = uint8(v)
+		}
+	}
+	img.Radiance = nil
+	return nil
+}
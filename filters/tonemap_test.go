@@ -0,0 +1,96 @@
+package filters
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// twoTones returns an image whose left half is dark and right half bright
+func twoTones() *image.RGBA64 {
+	res := image.NewRGBA64(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint16(0x2000)
+			if x >= 8 {
+				v = 0xC000
+			}
+			res.SetRGBA64(x, y, color.RGBA64{v, v, v, 0xFFFF})
+		}
+	}
+	return res
+}
+
+// hdrImage returns the image merged by hdr with a frame identical to it
+func hdrImage(t *testing.T) *FilterImage {
+	path := filepath.Join(t.TempDir(), "frame.png")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = png.Encode(file, twoTones())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := NewHDR([]string{"hdr", path, "exposures=1/100,1/100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := NewFilterImage(twoTones())
+	err = Apply(hdr, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Radiance == nil {
+		t.Fatal("hdr didn't set the radiance")
+	}
+	return img
+}
+
+func TestToneMapAfterFilter(t *testing.T) {
+	brightness, err := NewBrightness([]string{"brightness", "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tonemap, err := NewToneMap([]string{"tonemap", "reinhard"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a filter in between
+	direct := hdrImage(t)
+	err = Apply(tonemap, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := hdrImage(t)
+	img.SetLinear(false)
+	err = Apply(brightness, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Radiance != nil {
+		t.Fatal("brightness kept the radiance merged by hdr")
+	}
+	want := NewFilterImage(img.Image)
+	err = Apply(tonemap, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Apply(tonemap, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Image.Pix, want.Image.Pix) {
+		t.Error("tonemap didn't work on the image changed by brightness")
+	}
+	if bytes.Equal(img.Image.Pix, direct.Image.Pix) {
+		t.Error("brightness had no effect on the tone mapped image")
+	}
+}
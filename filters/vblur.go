@@ -1,44 +1,56 @@
 package filters
 
 import (
-	"errors"
-	"fmt"
 	"image"
 	"image/color"
-	"strconv"
 )
 
 // VBlur is a filter that adds a vertical blur to the image
 type VBlur struct {
-	Strength int
+	Strength Length // relative to the height of the image
+}
+
+// vblurSchema describes the parameters of vblur
+var vblurSchema = &Schema{
+	Name: "vblur",
+	Doc:  "adds a vertical blur to the image",
+	Params: []*Param{
+		{Name: "strength", Kind: PARAM_LENGTH, Range: Positive, Doc: "size of the blur, in pixels or % of the height"},
+	},
+}
+
+func init() {
+	Register(vblurSchema, func(argv []string) (Filter, error) {
+		return NewVBlur(argv)
+	})
 }
 
 // NewVBlur creates a new filter for blur
 func NewVBlur(argv []string) (*VBlur, error) {
-	if len(argv) != 2 {
-		return nil, errors.New("invalid syntax for vblur, expected usage: vblur <strength>")
-	}
-	strength, err := strconv.Atoi(argv[1])
+	args, err := vblurSchema.Parse(argv)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("invalid parameter for vblur: %s", err.Error()))
-	}
-	if strength > 0 {
-		return &VBlur{
-			strength,
-		}, nil
+		return nil, err
 	}
-	return nil, errors.New("parameter 'strenght' must be > 0")
+	return &VBlur{
+		args.Length("strength"),
+	}, nil
+}
+
+// Schema describes the parameters of the filter
+func (filter *VBlur) Schema() *Schema {
+	return vblurSchema
 }
 
 // Process applies a vertical blur filter to the image (efficient implementation)
 func (filter *VBlur) Process(img *FilterImage) error {
 	out := img.Image
 	bounds := out.Bounds()
+	strength := int(img.Scaled(filter.Strength, bounds.Dy()) + 0.5)
 	for x := bounds.Min.X; x < bounds.Max.X; x++ {
-		prev_blur := filter.computeInitialBlur(out, bounds, x)
+		prev_blur := filter.computeInitialBlur(out, bounds, strength, x)
 		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-			prev_y := ClipInt(y-filter.Strength/2, 0, bounds.Max.Y-1)
-			next_y := ClipInt(y+filter.Strength/2, 0, bounds.Max.Y-1)
+			prev_y := ClipInt(y-strength/2, 0, bounds.Max.Y-1)
+			next_y := ClipInt(y+strength/2, 0, bounds.Max.Y-1)
 
 			nb_elems := next_y - prev_y + 1
 
@@ -60,9 +72,9 @@ func (filter *VBlur) Process(img *FilterImage) error {
 }
 
 // computeInitialBlur computes the blur of the bound pixel
-func (filter *VBlur) computeInitialBlur(in image.Image, bounds image.Rectangle, x int) color.Color {
-	start := ClipInt(bounds.Min.Y-filter.Strength/2, 0, bounds.Max.Y)
-	end := ClipInt(bounds.Min.Y+filter.Strength/2, 0, bounds.Max.Y)
+func (filter *VBlur) computeInitialBlur(in image.Image, bounds image.Rectangle, strength int, x int) color.Color {
+	start := ClipInt(bounds.Min.Y-strength/2, 0, bounds.Max.Y)
+	end := ClipInt(bounds.Min.Y+strength/2, 0, bounds.Max.Y)
 
 	var vbr, vbg, vbb, vba int
 	for iter := start; iter <= end; iter++ {
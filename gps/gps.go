@@ -0,0 +1,53 @@
+// Package gps describes the position of the camera when a shot was taken,
+// as read from raw files and written along outputs.
+package gps
+
+import (
+	"math"
+	"time"
+)
+
+// meters per degree of latitude
+const metersPerDegree = 111320
+
+// Position is the position of the camera when the shot was taken
+type Position struct {
+	Latitude  float64   // in degrees, negative in the southern hemisphere
+	Longitude float64   // in degrees, negative west of Greenwich
+	Altitude  float64   // in meters, negative below sea level
+	Time      time.Time // UTC, zero if unknown
+}
+
+// Fuzzed returns the position snapped to the center of a grid of cells
+// of the given size in meters, so that it can't be located more precisely,
+// the time being truncated to the day
+func (p *Position) Fuzzed(meters float64) *Position {
+	res := *p
+	if !p.Time.IsZero() {
+		t := p.Time.UTC()
+		res.Time = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	if meters <= 0 {
+		return &res
+	}
+	snap := func(v float64, step float64) float64 {
+		return (math.Floor(v/step) + 0.5) * step
+	}
+	res.Latitude = snap(p.Latitude, meters/metersPerDegree)
+	scale := math.Max(math.Cos(res.Latitude*math.Pi/180), 0.01)
+	res.Longitude = snap(p.Longitude, meters/(metersPerDegree*scale))
+	res.Altitude = math.Round(p.Altitude/meters) * meters
+	return &res
+}
+
+// DMS splits the absolute value of an angle into degrees, minutes and
+// seconds, the seconds being rounded to hundredths (59.999 seconds carry
+// into the next minute)
+func DMS(angle float64) [3]float64 {
+	hundredths := math.Round(math.Abs(angle) * 360000)
+	return [3]float64{
+		math.Floor(hundredths / 360000),
+		math.Floor(math.Mod(hundredths, 360000) / 6000),
+		math.Mod(hundredths, 6000) / 100,
+	}
+}
@@ -0,0 +1,39 @@
+package gps
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDMS(t *testing.T) {
+	tests := []struct {
+		angle float64
+		want  [3]float64
+	}{
+		{48 + 51.0/60 + 24.42/3600, [3]float64{48, 51, 24.42}},
+		{-(2 + 17.0/60 + 40.2/3600), [3]float64{2, 17, 40.2}},
+		// seconds rounding up carry into minutes and degrees
+		{48 + 51.0/60 + 59.999/3600, [3]float64{48, 52, 0}},
+		{48 + 59.0/60 + 59.999/3600, [3]float64{49, 0, 0}},
+		{0, [3]float64{0, 0, 0}},
+	}
+	for _, test := range tests {
+		if got := DMS(test.angle); got != test.want {
+			t.Errorf("DMS(%v) = %v, want %v", test.angle, got, test.want)
+		}
+	}
+}
+
+func TestFuzzed(t *testing.T) {
+	p := &Position{48.856783, 2.294500, 35, time.Date(2026, 10, 1, 12, 34, 56, 0, time.UTC)}
+	f := p.Fuzzed(1000)
+	if !f.Time.Equal(time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("time %v isn't truncated to the day", f.Time)
+	}
+	if f.Fuzzed(1000).Latitude != f.Latitude || f.Fuzzed(1000).Longitude != f.Longitude {
+		t.Error("fuzzed position moves when fuzzed again")
+	}
+	if d := (f.Latitude - p.Latitude) * metersPerDegree; d > 500 || d < -500 {
+		t.Errorf("latitude moved by %v meters", d)
+	}
+}
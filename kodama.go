@@ -2,64 +2,148 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
 	"image"
-	"image/draw"
 	"image/jpeg"
 	"io"
-	_ "github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/dng"
 	"github.com/aimxhaisse/kodama/filters"
+	"github.com/aimxhaisse/kodama/gps"
+	"github.com/aimxhaisse/kodama/xmp"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 )
 
 var input_file = flag.String("infile", "", "input file")
 
-// GetImage returns the image pointed by path
-func GetImage(p string) (*filters.FilterImage, error) {
-	file, err := os.Open(p)
+// readRaw reads the sensor data of the input of the step, nil if it isn't
+// a raw file
+func (s *Step) readRaw() (*cr2.Raw, error) {
+	switch strings.ToLower(filepath.Ext(s.Input)) {
+	case ".cr2":
+		f, err := s.OpenCR2()
+		if err != nil {
+			return nil, err
+		}
+		return f.Raw()
+	case ".dng":
+		file, err := os.Open(s.Input)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return dng.DecodeRaw(file)
+	}
+	return nil, nil
+}
+
+// GetImage returns the input of the step, decoded to linear light if
+// asked, raw files are processed by the given filters then developed with
+// the given options
+func GetImage(s *Step, linear bool, opts *cr2.DecodeOptions, raw_filters []filters.RawFilter) (*filters.FilterImage, error) {
+	var img image.Image
+	raw, err := s.readRaw()
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	img, _, err := image.Decode(file)
+	if raw != nil {
+		for _, f := range raw_filters {
+			err = f.ProcessRaw(raw)
+			if err != nil {
+				return nil, err
+			}
+		}
+		img, err = raw.Develop(opts)
+	} else {
+		var file *os.File
+		file, err = os.Open(s.Input)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		img, _, err = image.Decode(file)
+	}
 	if err != nil {
 		return nil, err
 	}
-	img64 := image.NewRGBA64(img.Bounds())
-	draw.Draw(img64, img64.Bounds(), img, image.Point{0, 0}, draw.Over)
-	return &filters.FilterImage{img64}, nil
+	res := filters.NewFilterImage(img)
+	res.SetLinear(linear)
+	res.Raw = opts
+
+	// the exposure time is only known for raw files
+	if m, err := s.Metadata(); err == nil && m != nil {
+		res.Exposure = m.ExposureTime
+	} else if strings.ToLower(filepath.Ext(s.Input)) == ".dng" {
+		res.Exposure, _ = filters.ReadExposure(s.Input)
+	}
+	return res, nil
 }
 
-// PutImage write the image to path
-func PutImage(image *filters.FilterImage, path string) {
+// PutImage write the image to path, encoded back to sRGB, along with a
+// position if it isn't nil
+func PutImage(image *filters.FilterImage, path string, position *gps.Position) {
 	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = jpeg.Encode(file, image.Image, nil)
+	defer file.Close()
+	image.SetLinear(false)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, image.Image, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the EXIF segment follows the start of image marker
+	data := buf.Bytes()
+	if position != nil {
+		data = append(append(append([]byte{}, data[:2]...), gpsExif(position)...), data[2:]...)
+	}
+	_, err = file.Write(data)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// how GPS positions of inputs are written along outputs
+const (
+	GPS_STRIP = iota // not written
+	GPS_FUZZ         // snapped to a grid
+	GPS_KEEP         // written as is
+)
+
 // Script contains the state of a script as well as its operations
 type Script struct {
 	Steps       []*Step
 	CurrentLine int
+	Linear      bool // process images in linear light
+	Reference   int  // longest side of the resolution lengths are given for
+	Raw         cr2.DecodeOptions // how raw inputs are developed
+	GPS         int     // how positions are written along outputs
+	GPSFuzz     float64 // size of the grid positions are snapped to, in meters
+	Sidecar     bool    // write XMP sidecars along outputs
 }
 
 // Step contains the instructions to perform
 type Step struct {
 	Instructions []*Instruction
+	Conditions   []*Condition // on the XMP properties of the input
 	Parent       *Script
 	Input        string
 	Output       string
 	Id           int
+
+	input_file *os.File  // input opened by OpenCR2, nil until then
+	input_cr2  *cr2.File // tags of the input, scanned once
 }
 
 // Instruction 
@@ -79,61 +163,24 @@ func NewInstruction(s *Step, tokens []string, id int) (*Instruction, error) {
 	res.Id = id
 
 	op := tokens[0]
+	if filters.Lookup(op) == nil {
+		return nil, s.Parent.Error(fmt.Sprintf("unknown operation: %s", op))
+	}
 
 	var err error
+	res.Operation, err = filters.New(tokens)
+	if err != nil {
+		return nil, s.Parent.Error(fmt.Sprintf("can't create %s: %s", op, err.Error()))
+	}
 
-	switch op {
-
-	case "blur":
-		res.Operation, err = filters.NewBlur(tokens)
-		if err != nil {
-			s.Parent.Error(fmt.Sprintf("can't create blur: %s", err.Error()))
-		}
-
-	case "vblur":
-		res.Operation, err = filters.NewVBlur(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create vblur: %s", err.Error()))
-		}
-
-	case "hblur":
-		res.Operation, err = filters.NewHBlur(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create hblur: %s", err.Error()))
-		}
-
-	case "brightness":
-		res.Operation, err = filters.NewBrightness(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create brightness: %s", err.Error()))
-		}
-
-	case "darkness":
-		res.Operation, err = filters.NewDarkness(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create darkness: %s", err.Error()))
-		}
-
-	case "saturation":
-		res.Operation, err = filters.NewSaturation(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create saturation: %s", err.Error()))
-		}
-
-	case "resize":
-		res.Operation, err = filters.NewResize(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create resize: %s", err.Error()))
-		}
-
-	case "merge":
-		res.Operation, err = filters.NewMerge(tokens)
-		if err != nil {
-			return nil, s.Parent.Error(fmt.Sprintf("can't create merge: %s", err.Error()))
+	// filters of the sensor data are applied before development, so
+	// they can't follow other instructions
+	if _, ok := res.Operation.(filters.RawFilter); ok {
+		for _, instr := range s.Instructions {
+			if _, ok := instr.Operation.(filters.RawFilter); !ok {
+				return nil, s.Parent.Error(fmt.Sprintf("%s works on the sensor data and must come before %s", op, instr.Argv[0]))
+			}
 		}
-
-	default:
-		return nil, s.Parent.Error(fmt.Sprintf("unknown operation: %s", op))
 	}
 
 	return &res, nil
@@ -152,6 +199,11 @@ func NewStep(s *Script, tokens []string, id int) (*Step, error) {
 	res.Output = tokens[3]
 	res.Id = id
 
+	_, err := expandTemplate(res.Output, func(string, string) (string, error) { return "", nil })
+	if err != nil {
+		return nil, s.Error(err.Error())
+	}
+
 	return &res, nil
 }
 
@@ -160,6 +212,8 @@ func NewScript(file *os.File) (*Script, error) {
 	reader := bufio.NewReader(file)
 
 	res := Script{}
+	res.Linear = true
+	res.Raw = cr2.DefaultDecodeOptions
 
 	var expect_step bool = true
 	var current_step *Step = nil
@@ -178,7 +232,12 @@ func NewScript(file *os.File) (*Script, error) {
 		if len(tokens) == 0 || len(tokens[0]) == 0 || (len(tokens[0]) > 0 && tokens[0][0] == '#') {
 			continue
 		}
-		if expect_step {
+		if expect_step && tokens[0] != "with" && len(res.Steps) == 0 {
+			err := res.SetOption(tokens)
+			if err != nil {
+				return nil, err
+			}
+		} else if expect_step {
 			new_step, err := NewStep(&res, tokens, len(res.Steps)+1)
 			if err != nil {
 				return nil, err
@@ -190,6 +249,12 @@ func NewScript(file *os.File) (*Script, error) {
 			if tokens[0] == "done" {
 				current_step = nil
 				expect_step = true
+			} else if tokens[0] == "if" {
+				cond, err := NewCondition(&res, tokens)
+				if err != nil {
+					return nil, err
+				}
+				current_step.Conditions = append(current_step.Conditions, cond)
 			} else {
 				new_instr, err := NewInstruction(current_step, tokens, len(current_step.Instructions)+1)
 				if err != nil {
@@ -203,6 +268,152 @@ func NewScript(file *os.File) (*Script, error) {
 	return &res, nil
 }
 
+// SetOption sets a script-level option, these come before the first step
+func (s *Script) SetOption(tokens []string) error {
+	switch tokens[0] {
+
+	case "linear":
+		if len(tokens) != 2 || (tokens[1] != "on" && tokens[1] != "off") {
+			return s.Error("syntax error, expected syntax: linear on|off")
+		}
+		s.Linear = tokens[1] == "on"
+
+	case "reference":
+		if len(tokens) != 2 {
+			return s.Error("syntax error, expected syntax: reference <size>")
+		}
+		size, err := strconv.Atoi(tokens[1])
+		if err != nil || size <= 0 {
+			return s.Error(fmt.Sprintf("invalid reference size: %s", tokens[1]))
+		}
+		s.Reference = size
+
+	case "demosaic":
+		if len(tokens) != 2 || (tokens[1] != "bilinear" && tokens[1] != "ahd") {
+			return s.Error("syntax error, expected syntax: demosaic bilinear|ahd")
+		}
+		s.Raw.Demosaic = cr2.DEMOSAIC_AHD
+		if tokens[1] == "bilinear" {
+			s.Raw.Demosaic = cr2.DEMOSAIC_BILINEAR
+		}
+
+	case "whitebalance":
+		s.Raw.WhiteBalance = [3]float64{}
+		if len(tokens) == 2 && (tokens[1] == "auto" || tokens[1] == "camera") {
+			s.Raw.AutoWhiteBalance = tokens[1] == "auto"
+			break
+		}
+		if len(tokens) != 4 {
+			return s.Error("syntax error, expected syntax: whitebalance auto|camera|<red> <green> <blue>")
+		}
+		for i := 0; i < 3; i++ {
+			mul, err := strconv.ParseFloat(tokens[i+1], 64)
+			if err != nil || mul <= 0 {
+				return s.Error(fmt.Sprintf("invalid white balance multiplier: %s", tokens[i+1]))
+			}
+			s.Raw.WhiteBalance[i] = mul
+		}
+
+	case "gps":
+		switch {
+		case len(tokens) == 2 && tokens[1] == "strip":
+			s.GPS = GPS_STRIP
+		case len(tokens) == 2 && tokens[1] == "keep":
+			s.GPS = GPS_KEEP
+		case len(tokens) == 3 && tokens[1] == "fuzz":
+			meters, err := strconv.ParseFloat(tokens[2], 64)
+			if err != nil || meters <= 0 {
+				return s.Error(fmt.Sprintf("invalid GPS fuzz distance: %s", tokens[2]))
+			}
+			s.GPS = GPS_FUZZ
+			s.GPSFuzz = meters
+		default:
+			return s.Error("syntax error, expected syntax: gps strip|keep|fuzz <meters>")
+		}
+
+	case "sidecar":
+		if len(tokens) != 2 || (tokens[1] != "on" && tokens[1] != "off") {
+			return s.Error("syntax error, expected syntax: sidecar on|off")
+		}
+		s.Sidecar = tokens[1] == "on"
+
+	default:
+		return s.Error(fmt.Sprintf("unknown option: %s", tokens[0]))
+	}
+
+	return nil
+}
+
+// OutputGPS returns the position of an input as it must be written
+// along outputs, nil if it must not be written
+func (s *Script) OutputGPS(g *gps.Position) *gps.Position {
+	if g == nil {
+		return nil
+	}
+	switch s.GPS {
+	case GPS_KEEP:
+		return g
+	case GPS_FUZZ:
+		return g.Fuzzed(s.GPSFuzz)
+	}
+	return nil
+}
+
+// OutputGPS returns the position of the input of the step as it must be
+// written along its output, nil if it has none or must not be written
+func (s *Step) OutputGPS() (*gps.Position, error) {
+	if s.Parent.GPS == GPS_STRIP || strings.ToLower(filepath.Ext(s.Input)) != ".cr2" {
+		return nil, nil
+	}
+	m, err := s.Metadata()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't read metadata of %s: %s", s.Input, err.Error()))
+	}
+	return s.Parent.OutputGPS(m.GPS), nil
+}
+
+// OpenCR2 opens the input of the step as a CR2 file, its tags being
+// scanned once for the whole step; it stays open until Close
+func (s *Step) OpenCR2() (*cr2.File, error) {
+	if s.input_cr2 != nil {
+		return s.input_cr2, nil
+	}
+	file, err := os.Open(s.Input)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		s.input_cr2, err = cr2.Open(file, info.Size())
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.input_file = file
+	return s.input_cr2, nil
+}
+
+// Metadata returns the metadata of a CR2 input, nil for other inputs
+func (s *Step) Metadata() (*cr2.Metadata, error) {
+	if strings.ToLower(filepath.Ext(s.Input)) != ".cr2" {
+		return nil, nil
+	}
+	f, err := s.OpenCR2()
+	if err != nil {
+		return nil, err
+	}
+	return f.Metadata(), nil
+}
+
+// Close closes the input of the step if OpenCR2 opened it
+func (s *Step) Close() {
+	if s.input_file != nil {
+		s.input_file.Close()
+		s.input_file, s.input_cr2 = nil, nil
+	}
+}
+
 // Error returns a new error with extra information about the context
 func (s *Script) Error(e string) error {
 	return errors.New(fmt.Sprintf("error on line %d: %s", s.CurrentLine, e))
@@ -210,33 +421,126 @@ func (s *Script) Error(e string) error {
 
 // Execute executes the script
 func (s *Script) Execute() error {
-	for i := 0; i < len(s.Steps); i++ {
-		cur_step := s.Steps[i]
-		fmt.Printf("step %d/%d (<- %s)\n", cur_step.Id, len(s.Steps), cur_step.Input)
-		img, err := GetImage(cur_step.Input)
+	for _, cur_step := range s.Steps {
+		err := s.executeStep(cur_step)
 		if err != nil {
-			return errors.New(fmt.Sprintf("can't open input %s: %s", cur_step.Input, err.Error()))
+			return err
 		}
+	}
+	return nil
+}
 
-		for j := 0; j < len(cur_step.Instructions); j++ {
-			cur_instr := cur_step.Instructions[j]
-			fmt.Printf("\tinstruction %d/%d (%s)... ", cur_instr.Id, len(cur_step.Instructions), cur_instr.Argv[0])
-			op := cur_instr.Operation
-			err = op.Process(img)
-			if err != nil {
-				return errors.New(fmt.Sprintf("can't process operation %s: %s", cur_instr.Argv[0], err.Error()))
+// executeStep processes the input of a step and writes its output
+func (s *Script) executeStep(cur_step *Step) error {
+	defer cur_step.Close()
+	fmt.Printf("step %d/%d (<- %s)\n", cur_step.Id, len(s.Steps), cur_step.Input)
+	props := &xmp.Packet{}
+	if len(cur_step.Conditions) > 0 || s.Sidecar {
+		var err error
+		props, err = cur_step.InputXMP()
+		if err != nil {
+			return errors.New(fmt.Sprintf("can't read XMP of %s: %s", cur_step.Input, err.Error()))
+		}
+	}
+	skip := false
+	for _, cond := range cur_step.Conditions {
+		skip = skip || !cond.Match(props)
+	}
+	if skip {
+		fmt.Printf("skipped (conditions not met)\n")
+		return nil
+	}
+	output, err := cur_step.OutputPath()
+	if err != nil {
+		return err
+	}
+
+	// filters of the sensor data of raw inputs, first in the step, are
+	// applied before development
+	raw_filters := []filters.RawFilter{}
+	if filters.IsRaw(cur_step.Input) {
+		for _, instr := range cur_step.Instructions {
+			if f, ok := instr.Operation.(filters.RawFilter); ok {
+				raw_filters = append(raw_filters, f)
+			}
+		}
+	}
+	img, err := GetImage(cur_step, s.Linear, &s.Raw, raw_filters)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't open input %s: %s", cur_step.Input, err.Error()))
+	}
+	img.Reference = s.Reference
+
+	for j := 0; j < len(cur_step.Instructions); j++ {
+		cur_instr := cur_step.Instructions[j]
+		fmt.Printf("\tinstruction %d/%d (%s)... ", cur_instr.Id, len(cur_step.Instructions), cur_instr.Argv[0])
+		op := cur_instr.Operation
+		if _, ok := op.(filters.RawFilter); ok && len(raw_filters) > 0 {
+			fmt.Printf("done (before development)\n")
+			continue
+		}
+		_, perceptual := op.(filters.Perceptual)
+		img.SetLinear(s.Linear && !perceptual)
+		err = filters.Apply(op, img)
+		if err != nil {
+			return errors.New(fmt.Sprintf("can't process operation %s: %s", cur_instr.Argv[0], err.Error()))
+		}
+		fmt.Printf("done\n")
+		if r, ok := op.(filters.Reporter); ok {
+			for _, line := range r.Report() {
+				fmt.Printf("\t\t%s\n", line)
 			}
-			fmt.Printf("done\n")
 		}
-		PutImage(img, cur_step.Output)
-		fmt.Printf("done (-> %s)\n", cur_step.Output)
 	}
+	err = os.MkdirAll(filepath.Dir(output), 0755)
+	if err != nil {
+		return err
+	}
+	position, err := cur_step.OutputGPS()
+	if err != nil {
+		return err
+	}
+	PutImage(img, output, position)
+	if s.Sidecar {
+		err = cur_step.WriteSidecar(output, props)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("done (-> %s)\n", output)
 	return nil
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-infile script]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s <command> [arguments]\n\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\ncommands:\n")
+		names := []string{}
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %s\n\t%s\n", commands[name].Usage, commands[name].Doc)
+		}
+	}
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		c, ok := commands[flag.Arg(0)]
+		if !ok {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err := c.Run(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var in *os.File
 
 	if len(*input_file) == 0 {
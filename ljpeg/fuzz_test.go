@@ -0,0 +1,28 @@
+package ljpeg
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func FuzzDecode(f *testing.F) {
+	data, err := os.ReadFile("testdata/small.ljpeg")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		config, err := DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		img, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if img.Width != config.Width || img.Height != config.Height || img.Components != config.Components {
+			t.Errorf("decoded %dx%dx%d, config is %dx%dx%d", img.Width, img.Height, img.Components, config.Width, config.Height, config.Components)
+		}
+	})
+}
@@ -0,0 +1,548 @@
+// Package ljpeg implements a decoder for lossless JPEG images (ITU-T.81
+// process 14), as found in the raw files of digital cameras.
+package ljpeg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// A FormatError reports that the input is not a valid lossless JPEG
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "ljpeg: invalid format: " + string(e)
+}
+
+// An UnsupportedError reports that the input uses a valid but unimplemented feature
+type UnsupportedError string
+
+func (e UnsupportedError) Error() string {
+	return "ljpeg: unsupported feature: " + string(e)
+}
+
+// markers used by lossless JPEG
+const (
+	SOF3 = 0xC3 // start of frame (lossless, huffman)
+	DHT  = 0xC4 // define huffman table
+	RST0 = 0xD0 // restart
+	RST7 = 0xD7
+	SOI  = 0xD8 // start of image
+	EOI  = 0xD9 // end of image
+	SOS  = 0xDA // start of scan
+	DRI  = 0xDD // define restart interval
+)
+
+// MAX_SAMPLES is the greatest number of samples of a frame read from a
+// stream of unknown size
+const MAX_SAMPLES = 1 << 28
+
+// Config describes the frame of a lossless JPEG
+type Config struct {
+	Width      int // samples per line, for each component
+	Height     int // number of lines
+	Components int // number of interleaved components
+	Precision  int // bits per sample
+}
+
+// Image contains the decoded samples of a lossless JPEG
+type Image struct {
+	Config
+	Pix []uint16 // Height lines of Width*Components interleaved samples
+}
+
+// component of the frame
+type component struct {
+	id    uint8
+	table int // huffman table used for this component
+}
+
+// lutBits is the number of bits resolved at once by huffman lookup tables
+const lutBits = 9
+
+// huffman is a decoding table
+type huffman struct {
+	lut     [1 << lutBits]uint16 // (length << 8 | value), 0 if the code is longer
+	maxcode [17]int32            // greatest code of each length, -1 if none
+	valptr  [17]int32            // index in values of the first code of each length
+	mincode [17]int32            // first code of each length
+	values  []uint8
+}
+
+// decoder holds the state of the decoding
+type decoder struct {
+	r         *bufio.Reader
+	config    Config
+	frame     bool
+	comps     []component
+	huff      [4]*huffman
+	restart   int // restart interval, in MCUs
+	predictor int
+	transform uint
+	bits      uint32 // bit buffer
+	nbits     uint   // number of valid bits in the buffer
+	marker    byte   // marker found while reading entropy coded data
+	limit     int64  // greatest number of samples of the frame
+	tmp       [256]byte
+}
+
+// readFull reads exactly len(p) bytes
+func (d *decoder) readFull(p []byte) error {
+	_, err := io.ReadFull(d.r, p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readMarker returns the next marker, skipping fill bytes
+func (d *decoder) readMarker() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, FormatError("missing marker")
+	}
+	for b == 0xFF {
+		b, err = d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// readSegment reads the payload of a marker segment
+func (d *decoder) readSegment() ([]byte, error) {
+	err := d.readFull(d.tmp[:2])
+	if err != nil {
+		return nil, err
+	}
+	n := int(d.tmp[0])<<8 | int(d.tmp[1])
+	if n < 2 {
+		return nil, FormatError("short segment length")
+	}
+	res := make([]byte, n-2)
+	err = d.readFull(res)
+	return res, err
+}
+
+// processSOF3 reads the frame header
+func (d *decoder) processSOF3(p []byte) error {
+	if d.frame {
+		return FormatError("multiple frames")
+	}
+	if len(p) < 6 {
+		return FormatError("short SOF3 segment")
+	}
+	d.config.Precision = int(p[0])
+	d.config.Height = int(p[1])<<8 | int(p[2])
+	d.config.Width = int(p[3])<<8 | int(p[4])
+	d.config.Components = int(p[5])
+	if d.config.Precision < 2 || d.config.Precision > 16 {
+		return FormatError(fmt.Sprintf("bad precision %d", d.config.Precision))
+	}
+	if d.config.Components < 1 || d.config.Components > 4 {
+		return UnsupportedError(fmt.Sprintf("%d components", d.config.Components))
+	}
+	if d.config.Width == 0 || d.config.Height == 0 {
+		return UnsupportedError("frames of unknown dimensions")
+	}
+	if len(p) != 6+3*d.config.Components {
+		return FormatError("bad SOF3 length")
+	}
+	if int64(d.config.Width)*int64(d.config.Height)*int64(d.config.Components) > d.limit {
+		return FormatError("frame larger than its data")
+	}
+	d.comps = make([]component, d.config.Components)
+	for i := range d.comps {
+		d.comps[i].id = p[6+3*i]
+		if p[7+3*i] != 0x11 {
+			return UnsupportedError("subsampled components")
+		}
+	}
+	d.frame = true
+	return nil
+}
+
+// processDHT reads one or more huffman tables
+func (d *decoder) processDHT(p []byte) error {
+	for len(p) > 0 {
+		if len(p) < 17 {
+			return FormatError("short DHT segment")
+		}
+		class := p[0] >> 4
+		id := int(p[0] & 0x0F)
+		if class != 0 || id > 3 {
+			return FormatError("bad huffman table")
+		}
+		h := &huffman{}
+		total := 0
+		for i := 1; i <= 16; i++ {
+			total += int(p[i])
+		}
+		if total > 256 || len(p) < 17+total {
+			return FormatError("bad huffman table length")
+		}
+		h.values = append([]uint8(nil), p[17:17+total]...)
+
+		// canonical codes (ITU-T.81 annex C), and the lookup table for short ones
+		code := int32(0)
+		k := int32(0)
+		for length := 1; length <= 16; length++ {
+			n := int32(p[length])
+			h.valptr[length] = k
+			h.mincode[length] = code
+			h.maxcode[length] = -1
+			if n > 0 {
+				h.maxcode[length] = code + n - 1
+			}
+			for i := int32(0); i < n; i++ {
+				// codes of a length can't overflow it, nor the lookup table
+				if code >= 1<<uint(length) {
+					return FormatError("bad huffman codes")
+				}
+				if length <= lutBits {
+					shift := uint(lutBits - length)
+					for j := 0; j < 1<<shift; j++ {
+						h.lut[int(code)<<shift|j] = uint16(length)<<8 | uint16(h.values[k])
+					}
+				}
+				code++
+				k++
+			}
+			code <<= 1
+		}
+
+		d.huff[id] = h
+		p = p[17+total:]
+	}
+	return nil
+}
+
+// processDRI reads the restart interval
+func (d *decoder) processDRI(p []byte) error {
+	if len(p) != 2 {
+		return FormatError("bad DRI length")
+	}
+	d.restart = int(p[0])<<8 | int(p[1])
+	return nil
+}
+
+// processSOS reads the scan header
+func (d *decoder) processSOS(p []byte) error {
+	if !d.frame {
+		return FormatError("missing SOF3 marker")
+	}
+	if len(p) < 1 || int(p[0]) != len(d.comps) || len(p) != 4+2*len(d.comps) {
+		return UnsupportedError("scans of partial components")
+	}
+	for i := range d.comps {
+		id := p[1+2*i]
+		if id != d.comps[i].id {
+			return UnsupportedError("components out of order")
+		}
+		d.comps[i].table = int(p[2+2*i] >> 4)
+		if d.comps[i].table > 3 || d.huff[d.comps[i].table] == nil {
+			return FormatError("missing huffman table")
+		}
+	}
+	rest := p[1+2*len(d.comps):]
+	d.predictor = int(rest[0])
+	d.transform = uint(rest[2] & 0x0F)
+	if d.predictor < 1 || d.predictor > 7 {
+		return FormatError(fmt.Sprintf("bad predictor %d", d.predictor))
+	}
+	return nil
+}
+
+// fill adds a byte of entropy coded data to the bit buffer. Once a
+// marker is found, zeros are fed instead.
+func (d *decoder) fill() error {
+	b := byte(0)
+	if d.marker == 0 {
+		var err error
+		b, err = d.r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if b == 0xFF {
+			next, err := d.r.ReadByte()
+			if err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			if next != 0 {
+				// a marker, b is not data
+				d.marker = next
+				b = 0
+			}
+		}
+	}
+	d.bits = d.bits<<8 | uint32(b)
+	d.nbits += 8
+	return nil
+}
+
+// receive reads n bits
+func (d *decoder) receive(n uint) (int32, error) {
+	for d.nbits < n {
+		err := d.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	d.nbits -= n
+	return int32(d.bits>>d.nbits) & (1<<n - 1), nil
+}
+
+// decodeHuffman reads a huffman code
+func (d *decoder) decodeHuffman(h *huffman) (uint8, error) {
+	for d.nbits < lutBits {
+		err := d.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	v := h.lut[(d.bits>>(d.nbits-lutBits))&(1<<lutBits-1)]
+	if v != 0 {
+		d.nbits -= uint(v >> 8)
+		return uint8(v), nil
+	}
+
+	// slow path, for long codes
+	code := int32(0)
+	for length := 1; length <= 16; length++ {
+		bit, err := d.receive(1)
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | bit
+		if code <= h.maxcode[length] {
+			return h.values[h.valptr[length]+code-h.mincode[length]], nil
+		}
+	}
+	return 0, FormatError("bad huffman code")
+}
+
+// decodeDiff reads a difference to the prediction
+func (d *decoder) decodeDiff(h *huffman) (int32, error) {
+	s, err := d.decodeHuffman(h)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case s == 0:
+		return 0, nil
+	case s == 16:
+		return 32768, nil
+	case s > 16:
+		return 0, FormatError("bad difference length")
+	}
+	v, err := d.receive(uint(s))
+	if err != nil {
+		return 0, err
+	}
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v, nil
+}
+
+// processRestart expects a restart marker and resets the bit buffer
+func (d *decoder) processRestart() error {
+	if d.marker == 0 {
+		// skip the padding bits up to the marker
+		for {
+			b, err := d.r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if b != 0xFF {
+				continue
+			}
+			for b == 0xFF {
+				b, err = d.r.ReadByte()
+				if err != nil {
+					return err
+				}
+			}
+			if b != 0 {
+				d.marker = b
+				break
+			}
+		}
+	}
+	if d.marker < RST0 || d.marker > RST7 {
+		return FormatError("missing restart marker")
+	}
+	d.marker = 0
+	d.bits = 0
+	d.nbits = 0
+	return nil
+}
+
+// decodeScan decodes the samples of the scan
+func (d *decoder) decodeScan() (*Image, error) {
+	c := d.config
+	line := c.Width * c.Components
+	img := &Image{c, make([]uint16, line*c.Height)}
+	pix := img.Pix
+	initial := int32(1) << uint(c.Precision-int(d.transform)-1)
+
+	mcus := 0
+	first_line := true
+	reset := true
+	for row := 0; row < c.Height; row++ {
+		for col := 0; col < c.Width; col++ {
+			if d.restart > 0 && mcus > 0 && mcus%d.restart == 0 {
+				err := d.processRestart()
+				if err != nil {
+					return nil, err
+				}
+				first_line = true
+				reset = true
+			}
+
+			for i, comp := range d.comps {
+				diff, err := d.decodeDiff(d.huff[comp.table])
+				if err != nil {
+					return nil, err
+				}
+
+				idx := row*line + col*c.Components + i
+				var pred int32
+				switch {
+				case reset:
+					pred = initial
+				case first_line:
+					pred = int32(pix[idx-c.Components])
+				case col == 0:
+					pred = int32(pix[idx-line])
+				default:
+					ra := int32(pix[idx-c.Components])
+					rb := int32(pix[idx-line])
+					rc := int32(pix[idx-line-c.Components])
+					switch d.predictor {
+					case 1:
+						pred = ra
+					case 2:
+						pred = rb
+					case 3:
+						pred = rc
+					case 4:
+						pred = ra + rb - rc
+					case 5:
+						pred = ra + ((rb - rc) >> 1)
+					case 6:
+						pred = rb + ((ra - rc) >> 1)
+					case 7:
+						pred = (ra + rb) >> 1
+					}
+				}
+				pix[idx] = uint16(pred + diff)
+			}
+			reset = false
+			mcus++
+		}
+		first_line = false
+	}
+
+	if d.transform > 0 {
+		for i := range pix {
+			pix[i] <<= d.transform
+		}
+	}
+	return img, nil
+}
+
+// decode reads markers up to the scan, which is decoded if configOnly is
+// false. Readers with a Size method, such as bytes.Reader or
+// io.SectionReader, can't hold frames of more than 8 samples per byte, a
+// sample taking at least one bit; other frames are limited to MAX_SAMPLES.
+func (d *decoder) decode(r io.Reader, configOnly bool) (*Image, error) {
+	d.limit = MAX_SAMPLES
+	if s, ok := r.(interface{ Size() int64 }); ok {
+		d.limit = 8 * s.Size()
+	}
+	d.r = bufio.NewReader(r)
+	m, err := d.readMarker()
+	if err != nil {
+		return nil, err
+	}
+	if m != SOI {
+		return nil, FormatError("missing SOI marker")
+	}
+
+	for {
+		m, err = d.readMarker()
+		if err != nil {
+			return nil, err
+		}
+		if m == EOI {
+			return nil, FormatError("missing SOS marker")
+		}
+		if m >= RST0 && m <= RST7 {
+			continue
+		}
+		p, err := d.readSegment()
+		if err != nil {
+			return nil, err
+		}
+
+		switch m {
+
+		case SOF3:
+			err = d.processSOF3(p)
+			if err == nil && configOnly {
+				return &Image{Config: d.config}, nil
+			}
+
+		case DHT:
+			err = d.processDHT(p)
+
+		case DRI:
+			err = d.processDRI(p)
+
+		case SOS:
+			err = d.processSOS(p)
+			if err != nil {
+				return nil, err
+			}
+			return d.decodeScan()
+
+		default:
+			if m >= 0xC0 && m <= 0xCF && m != 0xC4 && m != 0xC8 && m != 0xCC {
+				err = UnsupportedError(fmt.Sprintf("frame type 0x%02X", m))
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Decode reads a lossless JPEG from r
+func Decode(r io.Reader) (*Image, error) {
+	var d decoder
+	return d.decode(r, false)
+}
+
+// DecodeConfig returns the frame header of a lossless JPEG without
+// decoding its samples
+func DecodeConfig(r io.Reader) (Config, error) {
+	var d decoder
+	img, err := d.decode(r, true)
+	if err != nil {
+		return Config{}, err
+	}
+	return img.Config, nil
+}
@@ -0,0 +1,54 @@
+package ljpeg
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// hugeFrame returns the start of a stream whose frame holds 65535x65535
+// samples of 4 components
+func hugeFrame() []byte {
+	return []byte{
+		0xFF, SOI,
+		0xFF, SOF3, 0, 20, 12, 0xFF, 0xFF, 0xFF, 0xFF, 4,
+		1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0, 4, 0x11, 0,
+		0xFF, EOI,
+	}
+}
+
+func TestDecodeHugeFrame(t *testing.T) {
+	_, err := Decode(bytes.NewReader(hugeFrame()))
+	if _, ok := err.(FormatError); !ok {
+		t.Errorf("got error %v, want a FormatError", err)
+	}
+	_, err = DecodeConfig(bytes.NewReader(hugeFrame()))
+	if _, ok := err.(FormatError); !ok {
+		t.Errorf("config: got error %v, want a FormatError", err)
+	}
+
+	// the size of other readers is unknown
+	_, err = Decode(struct{ io.Reader }{bytes.NewReader(hugeFrame())})
+	if _, ok := err.(FormatError); !ok {
+		t.Errorf("unsized reader: got error %v, want a FormatError", err)
+	}
+}
+
+func TestDecodeSmall(t *testing.T) {
+	data, err := os.ReadFile("testdata/small.ljpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Pix) != img.Width*img.Height*img.Components {
+		t.Errorf("got %d samples for a %dx%dx%d frame", len(img.Pix), img.Width, img.Height, img.Components)
+	}
+	_, err = Decode(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil {
+		t.Errorf("unsized reader: %v", err)
+	}
+}
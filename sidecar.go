@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aimxhaisse/kodama/xmp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Condition is a test on the XMP properties of the input of a step
+type Condition struct {
+	Property string // rating, label or keyword
+	Operator string
+	Value    string
+	Rating   int // value of rating tests
+}
+
+// NewCondition creates a condition from an if line of a step
+func NewCondition(s *Script, tokens []string) (*Condition, error) {
+	syntax := "syntax error, expected syntax: if rating ==|!=|<|<=|>|>= <stars> or if label|keyword ==|!= <value>"
+	if len(tokens) < 4 || tokens[0] != "if" {
+		return nil, s.Error(syntax)
+	}
+	res := &Condition{tokens[1], tokens[2], strings.Join(tokens[3:], " "), 0}
+	switch res.Property {
+	case "rating":
+		switch res.Operator {
+		case "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, s.Error(syntax)
+		}
+		var err error
+		res.Rating, err = strconv.Atoi(res.Value)
+		if err != nil || res.Rating < -1 || res.Rating > 5 {
+			return nil, s.Error(fmt.Sprintf("invalid rating: %s", res.Value))
+		}
+	case "label", "keyword":
+		if res.Operator != "==" && res.Operator != "!=" {
+			return nil, s.Error(syntax)
+		}
+	default:
+		return nil, s.Error(fmt.Sprintf("unknown property: %s", res.Property))
+	}
+	return res, nil
+}
+
+// Match checks if the properties of an input satisfy the condition, labels
+// and keywords being compared regardless of case
+func (c *Condition) Match(p *xmp.Packet) bool {
+	switch c.Property {
+	case "rating":
+		switch c.Operator {
+		case "==":
+			return p.Rating == c.Rating
+		case "!=":
+			return p.Rating != c.Rating
+		case "<":
+			return p.Rating < c.Rating
+		case "<=":
+			return p.Rating <= c.Rating
+		case ">":
+			return p.Rating > c.Rating
+		case ">=":
+			return p.Rating >= c.Rating
+		}
+	case "label":
+		return strings.EqualFold(p.Label, c.Value) == (c.Operator == "==")
+	case "keyword":
+		found := false
+		for _, k := range p.Keywords {
+			found = found || strings.EqualFold(k, c.Value)
+		}
+		return found == (c.Operator == "==")
+	}
+	return false
+}
+
+// InputXMP returns the XMP properties of the input of the step, read from
+// its sidecar (input.ext.xmp or input.xmp) if any, from the input itself
+// otherwise
+func (s *Step) InputXMP() (*xmp.Packet, error) {
+	p := s.Input
+	ext := filepath.Ext(p)
+	for _, sidecar := range []string{p + ".xmp", strings.TrimSuffix(p, ext) + ".xmp"} {
+		data, err := ioutil.ReadFile(sidecar)
+		if err == nil {
+			return xmp.Decode(data)
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	var data []byte
+	switch strings.ToLower(ext) {
+	case ".cr2":
+		m, err := s.Metadata()
+		if err != nil {
+			return nil, err
+		}
+		data = m.XMP
+	case ".jpg", ".jpeg":
+		file, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		data, err = xmp.ReadJPEG(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if data == nil {
+		return &xmp.Packet{}, nil
+	}
+	return xmp.Decode(data)
+}
+
+// WriteSidecar writes the XMP sidecar of an output (output.xmp), which
+// keeps the properties of the input and records the instructions of the
+// step, along with the position of the camera if the script allows it
+func (s *Step) WriteSidecar(output string, props *xmp.Packet) error {
+	res := *props
+	res.Source = s.Input
+	res.Pipeline = nil
+	for _, instr := range s.Instructions {
+		res.Pipeline = append(res.Pipeline, strings.Join(instr.Argv, " "))
+	}
+	var err error
+	res.GPS, err = s.OutputGPS()
+	if err != nil {
+		return err
+	}
+	sidecar := strings.TrimSuffix(output, filepath.Ext(output)) + ".xmp"
+	return ioutil.WriteFile(sidecar, res.Encode(), 0644)
+}
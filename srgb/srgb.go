@@ -0,0 +1,52 @@
+// Package srgb converts 16 bits color components between the sRGB
+// transfer function (IEC 61966-2-1) and linear light, with lookup tables
+// shared by the raw development and the filters.
+package srgb
+
+import (
+	"math"
+	"sync"
+)
+
+// lookup tables between 16 bits sRGB and linear light components
+var (
+	tables_once sync.Once
+	to_linear   [0x10000]uint16
+	to_srgb     [0x10000]uint16
+)
+
+// initTables computes the lookup tables, only once
+func initTables() {
+	tables_once.Do(func() {
+		for i := 0; i <= 0xFFFF; i++ {
+			v := float64(i) / 0xFFFF
+
+			var l, s float64
+			if v <= 0.04045 {
+				l = v / 12.92
+			} else {
+				l = math.Pow((v+0.055)/1.055, 2.4)
+			}
+			if v <= 0.0031308 {
+				s = v * 12.92
+			} else {
+				s = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+
+			to_linear[i] = uint16(math.Min(l*0xFFFF+0.5, 0xFFFF))
+			to_srgb[i] = uint16(math.Min(s*0xFFFF+0.5, 0xFFFF))
+		}
+	})
+}
+
+// ToLinear converts a 16 bits sRGB component to linear light
+func ToLinear(component uint16) uint16 {
+	initTables()
+	return to_linear[component]
+}
+
+// FromLinear converts a 16 bits linear light component to sRGB
+func FromLinear(component uint16) uint16 {
+	initTables()
+	return to_srgb[component]
+}
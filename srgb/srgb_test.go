@@ -0,0 +1,22 @@
+package srgb
+
+import (
+	"testing"
+)
+
+func TestTables(t *testing.T) {
+	for _, v := range []uint16{0, 0xFFFF} {
+		if ToLinear(v) != v || FromLinear(v) != v {
+			t.Errorf("%d isn't kept", v)
+		}
+	}
+	// middle gray
+	if v := FromLinear(0x8000); v < 0xBC38 || v > 0xBC48 {
+		t.Errorf("FromLinear(0x8000) = %#x, want about 0xbc40", v)
+	}
+	for i := 1; i <= 0xFFFF; i++ {
+		if ToLinear(uint16(i)) < ToLinear(uint16(i-1)) || FromLinear(uint16(i)) < FromLinear(uint16(i-1)) {
+			t.Fatalf("tables decrease at %d", i)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aimxhaisse/kodama/cr2"
+	"github.com/aimxhaisse/kodama/gps"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// expandTemplate replaces the placeholders of an output path: {key} or
+// {key:layout}, the layout being a Go time layout to format dates with,
+// optionally followed by |fallback, used when the value is empty once
+// sanitized by the value function (the fallback being sanitized as well)
+func expandTemplate(template string, value func(key string, layout string) (string, error)) (string, error) {
+	res := ""
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			if strings.IndexByte(template, '}') >= 0 {
+				return "", errors.New("unexpected } in output path")
+			}
+			return res + template, nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", errors.New("unterminated placeholder in output path")
+		}
+		if strings.IndexByte(template[:start], '}') >= 0 {
+			return "", errors.New("unexpected } in output path")
+		}
+		key := template[start+1 : start+end]
+		layout, fallback := "", ""
+		if i := strings.IndexByte(key, '|'); i >= 0 {
+			key, fallback = key[:i], key[i+1:]
+		}
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key, layout = key[:i], key[i+1:]
+		}
+		if key == "" {
+			return "", errors.New("empty placeholder in output path")
+		}
+		v, err := value(key, layout)
+		if err != nil {
+			return "", err
+		}
+		if v == "" {
+			v = sanitizeValue(fallback)
+		}
+		res += template[:start] + v
+		template = template[start+end+1:]
+	}
+}
+
+// inputTags returns the tags of a CR2 input by name, the first IFD
+// holding a tag winning; other inputs (nil metadata) have no tags
+func inputTags(m *cr2.Metadata) map[string]string {
+	res := make(map[string]string)
+	if m == nil {
+		return res
+	}
+	for _, dir := range m.Directories {
+		for name, v := range dir.Tags {
+			if _, ok := res[name]; !ok {
+				res[name] = v
+			}
+		}
+	}
+	return res
+}
+
+// gpsTags returns the tags of the GPS IFD of a position, formatted as the
+// ones of CR2 files
+func gpsTags(g *gps.Position) map[string]string {
+	format := func(values ...float64) string {
+		res := []string{}
+		for _, v := range values {
+			res = append(res, strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64))
+		}
+		return strings.Join(res, " ")
+	}
+	dms := func(v float64) string {
+		a := gps.DMS(v)
+		return format(a[0], a[1], a[2])
+	}
+	res := map[string]string{
+		"GPSVersionID":    "2 3 0 0",
+		"GPSLatitudeRef":  "N",
+		"GPSLatitude":     dms(g.Latitude),
+		"GPSLongitudeRef": "E",
+		"GPSLongitude":    dms(g.Longitude),
+		"GPSAltitudeRef":  "0",
+		"GPSAltitude":     format(math.Abs(g.Altitude)),
+	}
+	if g.Latitude < 0 {
+		res["GPSLatitudeRef"] = "S"
+	}
+	if g.Longitude < 0 {
+		res["GPSLongitudeRef"] = "W"
+	}
+	if g.Altitude < 0 {
+		res["GPSAltitudeRef"] = "1"
+	}
+	if !g.Time.IsZero() {
+		t := g.Time.UTC()
+		res["GPSTimeStamp"] = format(float64(t.Hour()), float64(t.Minute()), float64(t.Second()))
+		res["GPSDateStamp"] = t.Format("2006:01:02")
+	}
+	return res
+}
+
+// sanitizeValue makes a value usable as a part of a file name: path
+// separators and control characters are replaced by dashes and leading
+// dots are removed, so that it can't name a parent or hidden file
+func sanitizeValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == filepath.Separator || unicode.IsControl(r) {
+			return '-'
+		}
+		return r
+	}, v)
+	return strings.TrimLeft(strings.TrimSpace(v), ". ")
+}
+
+// OutputPath returns the output path of the step for its input: {name} is
+// the base name of the input without extension and other placeholders are
+// tags of the input (GPS ones as they would be written along the output),
+// missing tags being empty
+func (s *Step) OutputPath() (string, error) {
+	var tags map[string]string
+	return expandTemplate(s.Output, func(key string, layout string) (string, error) {
+		if key == "name" {
+			base := filepath.Base(s.Input)
+			return strings.TrimSuffix(base, filepath.Ext(base)), nil
+		}
+		if tags == nil {
+			m, err := s.Metadata()
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("can't read tags of %s: %s", s.Input, err.Error()))
+			}
+			tags = inputTags(m)
+
+			// the position follows the GPS policy of the script
+			if s.Parent.GPS != GPS_KEEP {
+				for name := range tags {
+					if strings.HasPrefix(name, "GPS") {
+						delete(tags, name)
+					}
+				}
+				g, err := s.OutputGPS()
+				if err != nil {
+					return "", err
+				}
+				if g != nil {
+					for name, v := range gpsTags(g) {
+						tags[name] = v
+					}
+				}
+			}
+		}
+		v := tags[key]
+		if v != "" && layout != "" {
+			date, err := time.Parse(cr2.DATE_LAYOUT, v)
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("tag %s of %s is not a date: %s", key, s.Input, v))
+			}
+			return date.Format(layout), nil
+		}
+		return sanitizeValue(v), nil
+	})
+}
@@ -0,0 +1,108 @@
+package tiff
+
+import "fmt"
+
+// TagNames associates names to tag ids
+type TagNames map[uint16]string
+
+// Names of known TIFF, Exif, CR2 and DNG tags
+var Names = TagNames{
+	0x00FE: "NewSubFileType",
+	0x0100: "ImageWidth",
+	0x0101: "ImageHeight",
+	0x0102: "BitsPerSample",
+	0x0103: "Compression",
+	0x0106: "PhotometricInterpretation",
+	0x010F: "Maker",
+	0x0110: "Model",
+	0x0111: "StripOffset",
+	0x0112: "Orientation",
+	0x0115: "SamplesPerPixel",
+	0x0116: "RowsPerStrip",
+	0x0117: "StripByteCounts",
+	0x011A: "XResolution",
+	0x011B: "YResolution",
+	0x011C: "PlanarConfiguration",
+	0x0128: "ResolutionUnit",
+	0x0132: "DateTime",
+	0x013B: "Artist",
+	0x0142: "TileWidth",
+	0x0143: "TileLength",
+	0x0144: "TileOffsets",
+	0x0145: "TileByteCounts",
+	0x014A: "SubIFDs",
+	0x0201: "JPEGInterchangeFormat",
+	0x0202: "JPEGInterchangeFormatLength",
+	0x02BC: "XMP",
+	0x828D: "CFARepeatPatternDim",
+	0x828E: "CFAPattern",
+	0x8298: "Copyright",
+	0x8769: "Exif",
+	0x8825: "GPSData",
+	0x829A: "ExposureTime",
+	0x829D: "FNumber",
+	0x8822: "ExposureProgram",
+	0x8827: "ISOSpeedRatings",
+	0x8830: "SensitivityType",
+	0x8832: "RecommendedExposureIndex",
+	0x9000: "ExifVersion",
+	0x9003: "DateTimeOriginal",
+	0x9004: "CreateDate",
+	0x9101: "ComponentsConfiguration",
+	0x9102: "CompressedBitsPerPixel",
+	0x9201: "ShutterSpeedValue",
+	0x9202: "ApertureValue",
+	0x9204: "ExposureCompensation",
+	0x9207: "MeteringMode",
+	0x9209: "Flash",
+	0x920A: "FocalLength",
+	0x927C: "MakerNoteCanon",
+	0x9286: "UserComment",
+	0x9290: "SubSecTime",
+	0x9291: "SubSecTimeOriginal",
+	0x9292: "SubSecTimeDigitized",
+	0xA000: "FlashpixVersion",
+	0xA001: "ColorSpace",
+	0xA002: "ExifImageWidth",
+	0xA003: "ExifImageHeight",
+	0xA005: "InteropOffset",
+	0xA20E: "FocalPlaneXResolution",
+	0xA20F: "FocalPlaneYResolution",
+	0xA210: "FocalPlaneResolutionUnit",
+	0xA401: "CustomRendered",
+	0xA402: "ExposureMode",
+	0xA403: "WhiteBalance",
+	0xA406: "SceneCaptureType",
+	0xA430: "OwnerName",
+	0xA431: "SerialNumber",
+	0xA432: "LensInfo",
+	0xA434: "LensModel",
+	0xA435: "LensSerialNumber",
+	0xC612: "DNGVersion",
+	0xC614: "UniqueCameraModel",
+	0xC618: "LinearizationTable",
+	0xC61A: "BlackLevel",
+	0xC61D: "WhiteLevel",
+	0xC61F: "DefaultCropOrigin",
+	0xC620: "DefaultCropSize",
+	0xC621: "ColorMatrix1",
+	0xC622: "ColorMatrix2",
+	0xC628: "AsShotNeutral",
+	0xC640: "CR2Slices",
+	0xC65A: "CalibrationIlluminant1",
+	0xC65B: "CalibrationIlluminant2",
+	0xC68D: "ActiveArea",
+}
+
+// Name returns the name of a tag, or UnknownTag(0xXXXX)
+func (n TagNames) Name(id uint16) string {
+	if k, ok := n[id]; ok {
+		return k
+	}
+	return fmt.Sprintf("UnknownTag(0x%04X)", id)
+}
+
+// Name returns the name of a TIFF tag, or UnknownTag(0xXXXX)
+func Name(id uint16) string {
+	return Names.Name(id)
+}
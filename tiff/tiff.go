@@ -0,0 +1,361 @@
+// Package tiff walks the image file directories (IFDs) of TIFF based
+// files, such as CR2, DNG or plain TIFF, in both byte orders.
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A FormatError reports that the input is not a valid TIFF file
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "tiff: invalid format: " + string(e)
+}
+
+// available kinds for a Tag
+const (
+	KIND_UNKNOWN = iota
+	KIND_UCHAR
+	KIND_STRING
+	KIND_USHORT
+	KIND_ULONG
+	KIND_URATIO
+	KIND_CHAR
+	KIND_BYTES
+	KIND_SHORT
+	KIND_LONG
+	KIND_RATIO
+	KIND_FLOAT32
+	KIND_FLOAT64
+)
+
+// size in bytes of a value of each kind
+var kind_sizes = map[uint16]uint32{
+	KIND_UCHAR:   1,
+	KIND_STRING:  1,
+	KIND_USHORT:  2,
+	KIND_ULONG:   4,
+	KIND_URATIO:  8,
+	KIND_CHAR:    1,
+	KIND_BYTES:   1,
+	KIND_SHORT:   2,
+	KIND_LONG:    4,
+	KIND_RATIO:   8,
+	KIND_FLOAT32: 4,
+	KIND_FLOAT64: 8,
+}
+
+// Tag is an entry of an IFD
+type Tag struct {
+	Id     uint16
+	Kind   uint16
+	Nb     uint32  // number of values
+	Value  uint32  // offset of the values, unless they fit in Inline
+	Inline [4]byte // the value field, as stored in the file
+}
+
+// String dumps the attributes of a Tag
+func (t Tag) String() string {
+	return fmt.Sprintf("id=0x%04x, kind=0x%04x, nb=0x%08x", t.Id, t.Kind, t.Nb)
+}
+
+// IFD is an image file directory
+type IFD struct {
+	Offset  uint32         // position of the IFD in the file
+	Entries map[uint16]Tag // tags, by id
+	Ids     []uint16       // ids of the tags, in file order
+	Next    uint32         // offset of the next IFD, 0 if it is the last one
+}
+
+// Reader reads IFDs and tag values from a TIFF file
+type Reader struct {
+	r     io.ReaderAt
+	Size  int64            // size of the file
+	Order binary.ByteOrder // II (little endian) or MM (big endian)
+	First uint32           // offset of the first IFD
+}
+
+// NewReader checks the header of a TIFF file of size bytes
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	head := make([]byte, 8)
+	if size < int64(len(head)) {
+		return nil, FormatError("short header")
+	}
+	_, err := r.ReadAt(head, 0)
+	if err != nil {
+		return nil, FormatError("short header")
+	}
+	res := &Reader{r: r, Size: size}
+	switch string(head[:4]) {
+	case "II\x2a\x00":
+		res.Order = binary.LittleEndian
+	case "MM\x00\x2a":
+		res.Order = binary.BigEndian
+	default:
+		return nil, FormatError("bad header")
+	}
+	res.First = res.Order.Uint32(head[4:])
+	return res, nil
+}
+
+// Contains checks if size bytes at offset are within the file
+func (r *Reader) Contains(offset int64, size int64) bool {
+	return offset >= 0 && size >= 0 && offset <= r.Size && size <= r.Size-offset
+}
+
+// ReadIFD reads the IFD at offset
+func (r *Reader) ReadIFD(offset uint32) (*IFD, error) {
+	if offset < 8 || !r.Contains(int64(offset), 2) {
+		return nil, FormatError(fmt.Sprintf("IFD offset 0x%08x out of bounds", offset))
+	}
+	raw := make([]byte, 2)
+	_, err := r.r.ReadAt(raw, int64(offset))
+	if err != nil {
+		return nil, err
+	}
+	nb_entries := int(r.Order.Uint16(raw))
+
+	// entries are followed by the offset of the next IFD
+	if !r.Contains(int64(offset)+2, int64(12*nb_entries+4)) {
+		return nil, FormatError(fmt.Sprintf("IFD at 0x%08x has too many entries (%d)", offset, nb_entries))
+	}
+	raw = make([]byte, 12*nb_entries+4)
+	_, err = r.r.ReadAt(raw, int64(offset)+2)
+	if err != nil {
+		return nil, err
+	}
+	res := &IFD{offset, make(map[uint16]Tag), nil, 0}
+	for i := 0; i < nb_entries; i++ {
+		e := raw[12*i:]
+		tag := Tag{
+			Id:    r.Order.Uint16(e),
+			Kind:  r.Order.Uint16(e[2:]),
+			Nb:    r.Order.Uint32(e[4:]),
+			Value: r.Order.Uint32(e[8:]),
+		}
+		copy(tag.Inline[:], e[8:12])
+		res.Entries[tag.Id] = tag
+		res.Ids = append(res.Ids, tag.Id)
+	}
+	res.Next = r.Order.Uint32(raw[12*nb_entries:])
+	return res, nil
+}
+
+// Data returns the raw bytes of the values of the tag, which are stored
+// in the tag itself when they fit in 4 bytes
+func (r *Reader) Data(t Tag) ([]byte, error) {
+	size, ok := kind_sizes[t.Kind]
+	if !ok {
+		return nil, FormatError(fmt.Sprintf("unknown kind %d for tag 0x%04x", t.Kind, t.Id))
+	}
+	length := int64(size) * int64(t.Nb)
+	if length <= 4 {
+		raw := make([]byte, length)
+		copy(raw, t.Inline[:])
+		return raw, nil
+	}
+	if !r.Contains(int64(t.Value), length) {
+		return nil, FormatError(fmt.Sprintf("values of tag 0x%04x out of bounds", t.Id))
+	}
+	raw := make([]byte, length)
+	_, err := r.r.ReadAt(raw, int64(t.Value))
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// Uints returns the values of a tag of unsigned integers
+func (r *Reader) Uints(t Tag) ([]uint32, error) {
+	if t.Kind != KIND_UCHAR && t.Kind != KIND_USHORT && t.Kind != KIND_ULONG && t.Kind != KIND_BYTES {
+		return nil, FormatError(fmt.Sprintf("tag 0x%04x is not made of unsigned integers", t.Id))
+	}
+	raw, err := r.Data(t)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]uint32, t.Nb)
+	for i := range res {
+		switch t.Kind {
+		case KIND_USHORT:
+			res[i] = uint32(r.Order.Uint16(raw[2*i:]))
+		case KIND_ULONG:
+			res[i] = r.Order.Uint32(raw[4*i:])
+		default:
+			res[i] = uint32(raw[i])
+		}
+	}
+	return res, nil
+}
+
+// Uint returns the first value of a tag of unsigned integers
+func (r *Reader) Uint(t Tag) (uint32, error) {
+	values, err := r.Uints(t)
+	if err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, FormatError(fmt.Sprintf("tag 0x%04x has no value", t.Id))
+	}
+	return values[0], nil
+}
+
+// Rationals returns the values of a tag of signed or unsigned rationals,
+// zero for invalid ones
+func (r *Reader) Rationals(t Tag) ([]float64, error) {
+	if t.Kind != KIND_URATIO && t.Kind != KIND_RATIO {
+		return nil, FormatError(fmt.Sprintf("tag 0x%04x is not made of rationals", t.Id))
+	}
+	raw, err := r.Data(t)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]float64, t.Nb)
+	for i := range res {
+		num := r.Order.Uint32(raw[8*i:])
+		den := r.Order.Uint32(raw[8*i+4:])
+		if den == 0 {
+			continue
+		}
+		if t.Kind == KIND_RATIO {
+			res[i] = float64(int32(num)) / float64(int32(den))
+		} else {
+			res[i] = float64(num) / float64(den)
+		}
+	}
+	return res, nil
+}
+
+// Floats returns the values of a numeric tag, whatever its kind
+func (r *Reader) Floats(t Tag) ([]float64, error) {
+	switch t.Kind {
+	case KIND_URATIO, KIND_RATIO:
+		return r.Rationals(t)
+	case KIND_STRING:
+		return nil, FormatError(fmt.Sprintf("tag 0x%04x is not numeric", t.Id))
+	}
+	raw, err := r.Data(t)
+	if err != nil {
+		return nil, err
+	}
+	o := r.Order
+	res := make([]float64, t.Nb)
+	for i := range res {
+		switch t.Kind {
+		case KIND_CHAR:
+			res[i] = float64(int8(raw[i]))
+		case KIND_USHORT:
+			res[i] = float64(o.Uint16(raw[2*i:]))
+		case KIND_SHORT:
+			res[i] = float64(int16(o.Uint16(raw[2*i:])))
+		case KIND_ULONG:
+			res[i] = float64(o.Uint32(raw[4*i:]))
+		case KIND_LONG:
+			res[i] = float64(int32(o.Uint32(raw[4*i:])))
+		case KIND_FLOAT32:
+			res[i] = float64(math.Float32frombits(o.Uint32(raw[4*i:])))
+		case KIND_FLOAT64:
+			res[i] = math.Float64frombits(o.Uint64(raw[8*i:]))
+		default:
+			res[i] = float64(raw[i])
+		}
+	}
+	return res, nil
+}
+
+// arrays longer than this are truncated when formatted
+const maxPrettyValues = 64
+
+// formatRational returns a rational as a decimal number
+func formatRational(num float64, den float64) string {
+	if den == 0 {
+		return fmt.Sprintf("%g/0", num)
+	}
+	return strconv.FormatFloat(num/den, 'g', -1, 64)
+}
+
+// formatValue returns the i-th value of raw, made of values of the kind
+func (r *Reader) formatValue(kind uint16, raw []byte, i int) string {
+	o := r.Order
+	switch kind {
+	case KIND_UCHAR:
+		return strconv.Itoa(int(raw[i]))
+	case KIND_CHAR:
+		return strconv.Itoa(int(int8(raw[i])))
+	case KIND_USHORT:
+		return strconv.Itoa(int(o.Uint16(raw[2*i:])))
+	case KIND_SHORT:
+		return strconv.Itoa(int(int16(o.Uint16(raw[2*i:]))))
+	case KIND_ULONG:
+		return strconv.FormatUint(uint64(o.Uint32(raw[4*i:])), 10)
+	case KIND_LONG:
+		return strconv.Itoa(int(int32(o.Uint32(raw[4*i:]))))
+	case KIND_URATIO:
+		return formatRational(float64(o.Uint32(raw[8*i:])), float64(o.Uint32(raw[8*i+4:])))
+	case KIND_RATIO:
+		return formatRational(float64(int32(o.Uint32(raw[8*i:]))), float64(int32(o.Uint32(raw[8*i+4:]))))
+	case KIND_FLOAT32:
+		return strconv.FormatFloat(float64(math.Float32frombits(o.Uint32(raw[4*i:]))), 'g', -1, 32)
+	case KIND_FLOAT64:
+		return strconv.FormatFloat(math.Float64frombits(o.Uint64(raw[8*i:])), 'g', -1, 64)
+	}
+	return fmt.Sprintf("%02x", raw[i])
+}
+
+// isPrintable checks if raw is made of printable ASCII characters
+func isPrintable(raw []byte) bool {
+	for _, c := range raw {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// Format returns the values of the tag as text: strings are returned as
+// is, numbers are separated by spaces, rationals are written as decimals
+// and undefined data as text when printable, hexadecimal otherwise.
+func (r *Reader) Format(t Tag) (string, error) {
+	raw, err := r.Data(t)
+	if err != nil {
+		return "", err
+	}
+
+	switch t.Kind {
+
+	case KIND_STRING:
+		if i := bytes.IndexByte(raw, 0); i >= 0 {
+			raw = raw[:i]
+		}
+		return string(raw), nil
+
+	case KIND_BYTES:
+		text := bytes.TrimRight(raw, "\x00")
+		if len(text) > 0 && isPrintable(text) {
+			return string(text), nil
+		}
+		if len(raw) > maxPrettyValues {
+			return fmt.Sprintf("%x... (%d bytes)", raw[:maxPrettyValues], len(raw)), nil
+		}
+		return fmt.Sprintf("%x", raw), nil
+
+	default:
+		nb := int(t.Nb)
+		values := []string{}
+		for i := 0; i < nb && i < maxPrettyValues; i++ {
+			values = append(values, r.formatValue(t.Kind, raw, i))
+		}
+		v := strings.Join(values, " ")
+		if nb > maxPrettyValues {
+			v += fmt.Sprintf(" ... (%d values)", nb)
+		}
+		return v, nil
+	}
+}
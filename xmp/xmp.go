@@ -0,0 +1,229 @@
+// Package xmp reads the ratings, labels and keywords of XMP packets, as
+// embedded in images or stored in sidecar files, and writes sidecars
+// describing how kodama made an image.
+package xmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/aimxhaisse/kodama/gps"
+)
+
+// A FormatError reports that the input is not a valid XMP packet
+type FormatError string
+
+func (e FormatError) Error() string {
+	return "xmp: invalid format: " + string(e)
+}
+
+// namespaces of the properties read or written
+const (
+	NS_RDF    = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	NS_XMP    = "http://ns.adobe.com/xap/1.0/"
+	NS_DC     = "http://purl.org/dc/elements/1.1/"
+	NS_EXIF   = "http://ns.adobe.com/exif/1.0/"
+	NS_KODAMA = "https://github.com/aimxhaisse/kodama/ns/1.0/"
+)
+
+// prefix of the APP1 segments of JPEG files holding an XMP packet
+const jpegPrefix = NS_XMP + "\x00"
+
+// Packet contains the properties of an XMP packet
+type Packet struct {
+	Rating   int // from 1 to 5 stars, 0 if unrated and -1 if rejected
+	Label    string
+	Keywords []string
+
+	// only written
+	Source   string        // file the image was made from
+	Pipeline []string      // instructions applied to the source
+	GPS      *gps.Position // position of the camera, nil to omit it
+}
+
+// Decode parses an XMP packet, properties may be given as attributes or
+// elements of any rdf:Description
+func Decode(data []byte) (*Packet, error) {
+	res := &Packet{}
+	// packets embedded in files may be padded
+	dec := xml.NewDecoder(bytes.NewReader(bytes.TrimRight(data, "\x00")))
+	var stack []xml.Name
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, FormatError(err.Error())
+		}
+		switch t := tok.(type) {
+
+		case xml.StartElement:
+			stack = append(stack, t.Name)
+			if t.Name.Space == NS_RDF && t.Name.Local == "Description" {
+				for _, attr := range t.Attr {
+					err = res.set(attr.Name, attr.Value)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+
+		case xml.CharData:
+			value := strings.TrimSpace(string(t))
+			if len(stack) == 0 || value == "" {
+				continue
+			}
+			name := stack[len(stack)-1]
+			if name.Space == NS_RDF && name.Local == "li" {
+				// items of dc:subject are in a bag
+				if len(stack) >= 3 && stack[len(stack)-3] == (xml.Name{Space: NS_DC, Local: "subject"}) {
+					res.Keywords = append(res.Keywords, value)
+				}
+				continue
+			}
+			err = res.set(name, value)
+			if err != nil {
+				return nil, err
+			}
+
+		}
+	}
+	return res, nil
+}
+
+// set sets a simple property of the packet, unknown ones being ignored
+func (p *Packet) set(name xml.Name, value string) error {
+	if name.Space != NS_XMP {
+		return nil
+	}
+	switch name.Local {
+	case "Rating":
+		rating, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return FormatError(fmt.Sprintf("invalid rating %s", value))
+		}
+		p.Rating = int(rating)
+	case "Label":
+		p.Label = value
+	}
+	return nil
+}
+
+// ReadJPEG returns the XMP packet of a JPEG file, nil if it has none
+func ReadJPEG(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, 4)
+	_, err := io.ReadFull(br, head[:2])
+	if err != nil || head[0] != 0xFF || head[1] != 0xD8 {
+		return nil, FormatError("not a JPEG file")
+	}
+
+	// metadata segments come before the first scan
+	for {
+		_, err = io.ReadFull(br, head)
+		if err != nil {
+			return nil, err
+		}
+		if head[0] != 0xFF {
+			return nil, FormatError("bad JPEG marker")
+		}
+		marker := head[1]
+		size := int(head[2])<<8 | int(head[3])
+		if marker == 0xDA || marker == 0xD9 || size < 2 {
+			return nil, nil
+		}
+		segment := make([]byte, size-2)
+		_, err = io.ReadFull(br, segment)
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte(jpegPrefix)) {
+			return segment[len(jpegPrefix):], nil
+		}
+	}
+}
+
+// escape escapes text to be written in an attribute or an element
+func escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// coordinate formats an angle as an XMP GPS coordinate (degrees and
+// decimal minutes followed by a direction)
+func coordinate(v float64, positive string, negative string) string {
+	dir := positive
+	if v < 0 {
+		dir = negative
+		v = -v
+	}
+	minutes := math.Round(v*60e6) / 1e6
+	degrees := math.Floor(minutes / 60)
+	return fmt.Sprintf("%d,%.6f%s", int(degrees), minutes-degrees*60, dir)
+}
+
+// Encode returns the packet as an XMP sidecar file
+func (p *Packet) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("<?xpacket begin=\"\xef\xbb\xbf\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	fmt.Fprintf(&buf, " <rdf:RDF xmlns:rdf=\"%s\">\n", NS_RDF)
+	fmt.Fprintf(&buf, "  <rdf:Description rdf:about=\"\"\n")
+	fmt.Fprintf(&buf, "    xmlns:xmp=\"%s\"\n", NS_XMP)
+	fmt.Fprintf(&buf, "    xmlns:dc=\"%s\"\n", NS_DC)
+	fmt.Fprintf(&buf, "    xmlns:exif=\"%s\"\n", NS_EXIF)
+	fmt.Fprintf(&buf, "    xmlns:kodama=\"%s\"", NS_KODAMA)
+	if p.Rating != 0 {
+		fmt.Fprintf(&buf, "\n    xmp:Rating=\"%d\"", p.Rating)
+	}
+	if p.Label != "" {
+		fmt.Fprintf(&buf, "\n    xmp:Label=\"%s\"", escape(p.Label))
+	}
+	if p.Source != "" {
+		fmt.Fprintf(&buf, "\n    kodama:Source=\"%s\"", escape(p.Source))
+	}
+	if p.GPS != nil {
+		fmt.Fprintf(&buf, "\n    exif:GPSLatitude=\"%s\"", coordinate(p.GPS.Latitude, "N", "S"))
+		fmt.Fprintf(&buf, "\n    exif:GPSLongitude=\"%s\"", coordinate(p.GPS.Longitude, "E", "W"))
+		ref := 0
+		if p.GPS.Altitude < 0 {
+			ref = 1
+		}
+		fmt.Fprintf(&buf, "\n    exif:GPSAltitudeRef=\"%d\"", ref)
+		fmt.Fprintf(&buf, "\n    exif:GPSAltitude=\"%d/100\"", int(math.Round(math.Abs(p.GPS.Altitude)*100)))
+		if !p.GPS.Time.IsZero() {
+			fmt.Fprintf(&buf, "\n    exif:GPSTimeStamp=\"%s\"", p.GPS.Time.UTC().Format("2006-01-02T15:04:05Z"))
+		}
+	}
+	buf.WriteString(">\n")
+
+	if len(p.Keywords) > 0 {
+		buf.WriteString("   <dc:subject>\n    <rdf:Bag>\n")
+		for _, k := range p.Keywords {
+			fmt.Fprintf(&buf, "     <rdf:li>%s</rdf:li>\n", escape(k))
+		}
+		buf.WriteString("    </rdf:Bag>\n   </dc:subject>\n")
+	}
+	if len(p.Pipeline) > 0 {
+		buf.WriteString("   <kodama:Pipeline>\n    <rdf:Seq>\n")
+		for _, instr := range p.Pipeline {
+			fmt.Fprintf(&buf, "     <rdf:li>%s</rdf:li>\n", escape(instr))
+		}
+		buf.WriteString("    </rdf:Seq>\n   </kodama:Pipeline>\n")
+	}
+
+	buf.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n")
+	buf.WriteString("<?xpacket end=\"w\"?>\n")
+	return buf.Bytes()
+}